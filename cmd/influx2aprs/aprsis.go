@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acobaugh/aprs"
+)
+
+var (
+	errLoginRejected   = errors.New("APRS-IS login rejected")
+	errLoginUnverified = errors.New("APRS-IS login unverified, check callsign and passcode")
+)
+
+// isLoginError reports whether err was caused by the server refusing our
+// login rather than a network problem
+func isLoginError(err error) bool {
+	return errors.Is(err, errLoginRejected) || errors.Is(err, errLoginUnverified)
+}
+
+// genPass returns the APRS-IS passcode for call, which must already be
+// normalized. This is aprs.GenPass with the last character of odd length
+// callsigns hashed on its own, where aprs.GenPass reads past the end.
+func genPass(call string) int {
+	pass := uint16(0x73e2)
+	for i := 0; i < len(call); i += 2 {
+		pass ^= uint16(call[i]) << 8
+		if i+1 < len(call) {
+			pass ^= uint16(call[i+1])
+		}
+	}
+	return int(pass & 0x7fff)
+}
+
+// sendIS sends f to the APRS-IS server at dial. tcp:// servers are handled by
+// sendTCP so that the login response can be checked and the connect timeout
+// applied, anything else is handed to aprs.Frame.SendIS.
+func sendIS(f aprs.Frame, dial string, pass int, timeout time.Duration) error {
+	if !strings.HasPrefix(strings.ToLower(dial), "tcp://") {
+		return f.SendIS(dial, pass)
+	}
+	return sendTCP(f, dial[len("tcp://"):], pass, timeout)
+}
+
+// sendTCP logs in to the APRS-IS server at addr and sends f
+func sendTCP(f aprs.Frame, addr string, pass int, timeout time.Duration) error {
+	conn, _, err := loginTCP(addr, f.Src, pass, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\r\n", f)
+	return err
+}
+
+// loginTCP connects to the APRS-IS server at addr and logs in as call,
+// returning the connection and its reader positioned after the login response
+func loginTCP(addr string, call aprs.Addr, pass int, timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+	conn, err := dialServer(addr, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	fail := func(err error) (net.Conn, *bufio.Reader, error) {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// welcome banner
+	if _, err := readLine(conn, r); err != nil {
+		return fail(fmt.Errorf("failed to read server banner: %w", err))
+	}
+
+	_, err = fmt.Fprintf(conn, "user %s pass %d vers %s %s\r\n", call, pass, aprs.SwName, aprs.SwVers)
+	if err != nil {
+		return fail(err)
+	}
+
+	resp, err := readLine(conn, r)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read login response: %w", err))
+	}
+	if err := checkLogin(resp, pass); err != nil {
+		return fail(err)
+	}
+	return conn, r, nil
+}
+
+// dialServer connects to addr, trying each address the host resolves to in
+// turn so that one dead server in a DNS rotated pool fails fast instead of
+// stalling the send. A zero timeout leaves it to the OS.
+func dialServer(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(ip, port), timeout)
+		if err == nil {
+			return conn, nil
+		}
+		log.WithError(err).Warnf("Failed to connect to %s", ip)
+	}
+	return nil, err
+}
+
+// checkLogin parses the server's response to our login line, which looks like
+//
+//	# logresp N0CALL-13 verified, server T2EXAMPLE
+//
+// An unverified login is only acceptable when we didn't send a passcode.
+func checkLogin(resp string, pass int) error {
+	fields := strings.Fields(strings.TrimPrefix(resp, "# logresp "))
+	if !strings.HasPrefix(resp, "# logresp ") || len(fields) < 2 {
+		return fmt.Errorf("%w: %q", errLoginRejected, resp)
+	}
+
+	switch strings.TrimSuffix(fields[1], ",") {
+	case "verified":
+		return nil
+	case "unverified":
+		if pass < 0 {
+			return nil
+		}
+		return fmt.Errorf("%w: %q", errLoginUnverified, resp)
+	}
+	return fmt.Errorf("%w: %q", errLoginRejected, resp)
+}
+
+func readLine(conn net.Conn, r *bufio.Reader) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, err := r.ReadString('\n')
+	return strings.TrimSpace(s), err
+}
+
+// heldConn is a logged in APRS-IS connection kept open between sends for
+// aprsis.persistent, reconnecting on the next send after it fails
+type heldConn struct {
+	addr    string
+	pass    int
+	timeout time.Duration
+	// keepalive is how often a # comment line is sent so the server doesn't
+	// drop the connection as idle, 0 to disable
+	keepalive time.Duration
+	// quiet is how long the server may send nothing before the connection is
+	// assumed dead and replaced, 0 to disable. APRS-IS servers send a #
+	// comment about every 20 seconds.
+	quiet time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	// call is who we logged in as, for reconnecting
+	call aprs.Addr
+}
+
+// send sends f, connecting first if needed. A write on a connection that
+// died while idle is retried once on a new connection.
+func (h *heldConn) send(f aprs.Frame) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		reused := h.conn != nil
+		if !reused {
+			if err := h.connect(f.Src); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(h.conn, "%s\r\n", f)
+		if err == nil {
+			return nil
+		}
+		h.drop(h.conn)
+		if !reused || attempt > 0 {
+			return err
+		}
+		log.WithError(err).Warnf("Connection to %s lost, reconnecting", h.addr)
+	}
+}
+
+// connect logs in and starts reading from the connection, called with mu held
+func (h *heldConn) connect(call aprs.Addr) error {
+	conn, r, err := loginTCP(h.addr, call, h.pass, h.timeout)
+	if err != nil {
+		return err
+	}
+	log.Infof("Connected to %s", h.addr)
+	h.conn = conn
+	h.call = call
+	go h.read(conn, r)
+	if h.keepalive > 0 {
+		go h.keepAlive(conn)
+	}
+	return nil
+}
+
+// drop closes conn if it is still the held connection, called with mu held
+func (h *heldConn) drop(conn net.Conn) {
+	if h.conn == conn {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// read discards what the server sends, which must be consumed so the server
+// doesn't see us as stalled, until the connection fails. A connection quiet
+// for longer than quiet is replaced right away rather than on the next send,
+// since writes to a silently dead socket can appear to succeed.
+func (h *heldConn) read(conn net.Conn, r *bufio.Reader) {
+	conn.SetReadDeadline(time.Time{})
+	for {
+		if h.quiet > 0 {
+			conn.SetReadDeadline(time.Now().Add(h.quiet))
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			h.lost(conn, err)
+			return
+		}
+		log.Debugf("%s: %s", h.addr, strings.TrimSpace(line))
+	}
+}
+
+// lost drops conn after reading from it failed, reconnecting if it timed out
+func (h *heldConn) lost(conn net.Conn, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn != conn {
+		return
+	}
+	h.drop(conn)
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		log.WithError(err).Debugf("Stopped reading from %s", h.addr)
+		return
+	}
+	log.Warnf("Nothing from %s for %s, reconnecting", h.addr, h.quiet)
+	if err := h.connect(h.call); err != nil {
+		log.WithError(err).Errorf("Failed to reconnect to %s", h.addr)
+	}
+}
+
+// keepAlive sends a comment line every keepalive until conn is replaced
+func (h *heldConn) keepAlive(conn net.Conn) {
+	ticker := time.NewTicker(h.keepalive)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		if h.conn != conn {
+			h.mu.Unlock()
+			return
+		}
+		if _, err := fmt.Fprintf(conn, "# %s %s keepalive\r\n", aprs.SwName, aprs.SwVers); err != nil {
+			log.WithError(err).Warnf("Keepalive to %s failed", h.addr)
+			h.drop(conn)
+		}
+		h.mu.Unlock()
+	}
+}
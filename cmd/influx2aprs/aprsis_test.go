@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/acobaugh/aprs"
+	"github.com/acobaugh/aprs-tools/internal/aprsistest"
+)
+
+func TestCheckLogin(t *testing.T) {
+	cases := []struct {
+		name string
+		resp string
+		pass int
+		want error
+	}{
+		{"verified", "# logresp N0CALL-13 verified, server T2TEST", 13023, nil},
+		{"unverified without passcode", "# logresp N0CALL-13 unverified, server T2TEST", -1, nil},
+		{"unverified with passcode", "# logresp N0CALL-13 unverified, server T2TEST", 12345, errLoginUnverified},
+		{"garbage", "# javAPRSSrvr 4.3.0", 13023, errLoginRejected},
+		{"empty", "", 13023, errLoginRejected},
+	}
+	for _, c := range cases {
+		err := checkLogin(c.resp, c.pass)
+		if !errors.Is(err, c.want) || (c.want == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		if c.want != nil && !isLoginError(err) {
+			t.Errorf("%s: %v isn't a login error", c.name, err)
+		}
+	}
+}
+
+func TestSendUnverified(t *testing.T) {
+	srv := &aprsistest.Server{Unverified: true}
+	srv.Start()
+	defer srv.Close()
+
+	src, err := parseAddr("N0CALL-13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := aprs.Frame{Src: src, Dst: aprs.Addr{Call: "APRS"}, Text: ">test"}
+	err = sendIS(f, "tcp://"+srv.Addr, genPass("N0CALL"), time.Second)
+	if !isLoginError(err) || !errors.Is(err, errLoginUnverified) {
+		t.Errorf("got %v, want an unverified login error", err)
+	}
+	if frames := srv.Frames(); len(frames) != 0 {
+		t.Errorf("server received %q", frames)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// commentData is what the comment template is executed against
+type commentData struct {
+	observation
+	// Derived holds the computed derived values by name
+	Derived map[string]float64
+	// Seq numbers each beacon sent, see seqCounter
+	Seq int
+}
+
+// commentRule is a comment template used when its condition holds
+type commentRule struct {
+	// When is a template rendering true or false, e.g. '{{lt .Temp 32}}'
+	When string
+	// Text is the comment template
+	Text string
+
+	when, text *template.Template
+}
+
+// comments picks the comment template for an observation: the first rule
+// whose condition holds, otherwise fallback, or the next of rotation when set
+type comments struct {
+	rules    []commentRule
+	fallback *template.Template
+	rotation []*template.Template
+}
+
+// parseComment parses the comment config as a template. Plain text comments
+// are valid templates, so existing configs keep working.
+func parseComment(text string) (*template.Template, error) {
+	return template.New("comment").Funcs(templateFuncs).Parse(text)
+}
+
+// loadCommentRules reads and parses the comment_rules config
+func loadCommentRules(v *viper.Viper) ([]commentRule, error) {
+	var rules []commentRule
+	if err := v.UnmarshalKey("comment_rules", &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		r := &rules[i]
+		var err error
+		r.when, err = template.New("when").Funcs(templateFuncs).Option("missingkey=error").Parse(r.When)
+		if err != nil {
+			return nil, fmt.Errorf("comment_rules[%d] when: %w", i, err)
+		}
+		r.text, err = parseComment(r.Text)
+		if err != nil {
+			return nil, fmt.Errorf("comment_rules[%d] text: %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// loadCommentRotation parses each of the comments config as a template
+func loadCommentRotation(v *viper.Viper) ([]*template.Template, error) {
+	var rotation []*template.Template
+	for i, text := range v.GetStringSlice("comments") {
+		t, err := parseComment(text)
+		if err != nil {
+			return nil, fmt.Errorf("comments[%d]: %w", i, err)
+		}
+		rotation = append(rotation, t)
+	}
+	return rotation, nil
+}
+
+// render executes the chosen comment template. The rotation follows Seq, so
+// it is persisted with seq_file. Conditions see only the
+// fields present this tick, like derived values, so a condition on a missing
+// field doesn't hold.
+func (c comments) render(data commentData) (string, error) {
+	t := c.fallback
+	if len(c.rotation) > 0 {
+		// Seq starts at 1 and only advances once a beacon is sent
+		t = c.rotation[(data.Seq-1)%len(c.rotation)]
+	}
+	if len(c.rules) > 0 {
+		values := presentValues(data.observation)
+		values["Derived"] = data.Derived
+		for i, r := range c.rules {
+			var b bytes.Buffer
+			if err := r.when.Execute(&b, values); err != nil {
+				// a field missing this tick is expected, anything else is a
+				// mistake in the condition
+				if strings.Contains(err.Error(), "map has no entry for key") {
+					log.WithError(err).Debugf("comment_rules[%d] doesn't apply", i)
+				} else {
+					log.WithError(err).Warnf("comment_rules[%d] failed", i)
+				}
+				continue
+			}
+			if strings.TrimSpace(b.String()) == "true" {
+				t = r.text
+				break
+			}
+		}
+	}
+	return renderComment(t, data)
+}
+
+// renderComment executes the comment template
+func renderComment(t *template.Template, data commentData) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommentRulesFloatFields(t *testing.T) {
+	v := loadTestConfig(t, map[string]interface{}{
+		"comment": "normal",
+		"comment_rules": []interface{}{
+			map[string]interface{}{"when": "{{lt .TempF 32}}", "text": "freezing"},
+			map[string]interface{}{"when": "{{gt .Pressure 1020}}", "text": "high"},
+		},
+	})
+	rules, err := loadCommentRules(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := parseComment(v.GetString("comment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := comments{rules: rules, fallback: fallback}
+
+	cases := []struct {
+		tempF, pressure float64
+		want            string
+	}{
+		{20.5, 0, "freezing"},
+		{50, 1030.2, "high"},
+		{50, 1000, "normal"},
+		// pressure missing this tick
+		{50, 0, "normal"},
+	}
+	for _, tc := range cases {
+		var w observation
+		w.Zero()
+		w.Timestamp = time.Now()
+		w.TempF = tc.tempF
+		w.Temp = int(tc.tempF)
+		w.Pressure = tc.pressure
+		got, err := c.render(commentData{observation: w, Seq: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("TempF %g pressure %g: got %q, want %q", tc.tempF, tc.pressure, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/viper"
+)
+
+// secretKeys are masked by explainConfig and maskedSettings
+var secretKeys = map[string]bool{
+	"aprsis.passcode":   true,
+	"influxdb.token":    true,
+	"influxdb.password": true,
+}
+
+// secretMask replaces the value of a set secret when printing config
+const secretMask = "********"
+
+// configSources records the config file that last set each key, since viper
+// doesn't keep track of where a merged value came from
+type configSources map[string]string
+
+// merge records the keys set by file, which is read separately from the
+// merged config
+func (c configSources) merge(file string) error {
+	v := viper.New()
+	// as in main, so files without a .yaml extension parse the same
+	v.SetConfigType("yaml")
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	for _, key := range v.AllKeys() {
+		c[key] = file
+	}
+	return nil
+}
+
+// source returns where key's effective value comes from. This mirrors
+// viper.AutomaticEnv, which looks up the key upper cased.
+func (c configSources) source(key string) string {
+	env := strings.ToUpper(key)
+	if _, ok := os.LookupEnv(env); ok {
+		return "env " + env
+	}
+	if file, ok := c[key]; ok {
+		return "file " + file
+	}
+	return "default"
+}
+
+// explainConfig prints each key's effective value and its source
+func explainConfig(w io.Writer, sources configSources) {
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSOURCE\tVALUE")
+	for _, key := range keys {
+		value := fmt.Sprintf("%v", viper.Get(key))
+		if secretKeys[key] && value != "" {
+			value = secretMask
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", key, sources.source(key), value)
+	}
+	tw.Flush()
+}
+
+// maskedSettings returns viper.AllSettings with the set secretKeys masked,
+// for printing the parsed config
+func maskedSettings() map[string]interface{} {
+	settings := viper.AllSettings()
+	for key := range secretKeys {
+		path := strings.Split(key, ".")
+		m := settings
+		for _, p := range path[:len(path)-1] {
+			next, ok := m[p].(map[string]interface{})
+			if !ok {
+				m = nil
+				break
+			}
+			m = next
+		}
+		if m == nil {
+			continue
+		}
+		last := path[len(path)-1]
+		if v, ok := m[last]; ok && fmt.Sprintf("%v", v) != "" {
+			m[last] = secretMask
+		}
+	}
+	return settings
+}
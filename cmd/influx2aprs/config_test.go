@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMaskedSettings(t *testing.T) {
+	loadTestConfig(t, map[string]interface{}{
+		"influxdb.token":    "s3cret-token",
+		"influxdb.password": "",
+		"aprsis.passcode":   "12345",
+	})
+
+	b, err := yaml.Marshal(maskedSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, secret := range []string{"s3cret-token", "12345"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("secret %q printed:\n%s", secret, out)
+		}
+	}
+	if n := strings.Count(out, secretMask); n != 2 {
+		t.Errorf("got %d masked values, want 2:\n%s", n, out)
+	}
+
+	// the config itself is left alone
+	if got := viper.GetString("aprsis.passcode"); got != "12345" {
+		t.Errorf("aprsis.passcode: got %q", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// derivedValue is a user defined value computed from the observation and
+// made available to the comment template as {{.Derived.<name>}}
+type derivedValue struct {
+	Name string
+	// Expr is a template that renders a number, see templateFuncs
+	Expr string
+
+	tmpl *template.Template
+}
+
+// templateFuncs are the math functions available to derived values and the
+// comment template. Arguments may be ints or floats, so pipelines like
+// {{sub .Temp 32 | mul 0.5556}} work.
+var templateFuncs = template.FuncMap{
+	"add":   mathFunc2(func(a, b float64) float64 { return a + b }),
+	"sub":   mathFunc2(func(a, b float64) float64 { return a - b }),
+	"mul":   mathFunc2(func(a, b float64) float64 { return a * b }),
+	"div":   mathFunc2(func(a, b float64) float64 { return a / b }),
+	"pow":   mathFunc2(math.Pow),
+	"min":   mathFunc2(math.Min),
+	"max":   mathFunc2(math.Max),
+	"sqrt":  mathFunc1(math.Sqrt),
+	"exp":   mathFunc1(math.Exp),
+	"log":   mathFunc1(math.Log),
+	"abs":   mathFunc1(math.Abs),
+	"round": mathFunc1(math.Round),
+	// these replace the builtin comparisons, which fail comparing an int
+	// with a float such as {{lt .TempF 32}}
+	"lt": compareFunc(func(a, b float64) bool { return a < b }),
+	"le": compareFunc(func(a, b float64) bool { return a <= b }),
+	"gt": compareFunc(func(a, b float64) bool { return a > b }),
+	"ge": compareFunc(func(a, b float64) bool { return a >= b }),
+}
+
+func compareFunc(fn func(float64, float64) bool) func(interface{}, interface{}) (bool, error) {
+	return func(a, b interface{}) (bool, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return false, err
+		}
+		y, err := toNumber(b)
+		if err != nil {
+			return false, err
+		}
+		return fn(x, y), nil
+	}
+}
+
+func mathFunc1(fn func(float64) float64) func(interface{}) (float64, error) {
+	return func(a interface{}) (float64, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return 0, err
+		}
+		return fn(x), nil
+	}
+}
+
+func mathFunc2(fn func(float64, float64) float64) func(interface{}, interface{}) (float64, error) {
+	return func(a, b interface{}) (float64, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return 0, err
+		}
+		y, err := toNumber(b)
+		if err != nil {
+			return 0, err
+		}
+		return fn(x, y), nil
+	}
+}
+
+// toNumber accepts the numeric types that show up in templates
+func toNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	}
+	return toFloat(v)
+}
+
+// loadDerived reads and parses the derived config
+func loadDerived(v *viper.Viper) ([]derivedValue, error) {
+	var derived []derivedValue
+	if err := v.UnmarshalKey("derived", &derived); err != nil {
+		return nil, err
+	}
+	for i := range derived {
+		d := &derived[i]
+		if d.Name == "" {
+			return nil, fmt.Errorf("derived[%d]: name is required", i)
+		}
+		var err error
+		d.tmpl, err = template.New(d.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(d.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("derived %s: %w", d.Name, err)
+		}
+	}
+	return derived, nil
+}
+
+// computeDerived evaluates each derived value in order, so later values can
+// refer to earlier ones. Only fields populated this tick are visible, so a
+// value whose inputs are missing is skipped rather than computed from
+// placeholders like -1 humidity. Values that fail to evaluate are left out.
+func computeDerived(derived []derivedValue, data commentData) map[string]float64 {
+	values := presentValues(data.observation)
+	result := make(map[string]float64)
+	values["Derived"] = result
+	for _, d := range derived {
+		var b bytes.Buffer
+		if err := d.tmpl.Execute(&b, values); err != nil {
+			log.WithError(err).Debugf("Skipping derived value %s", d.Name)
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(b.String()), 64)
+		if err != nil {
+			log.WithError(err).Warnf("Derived value %s is not a number", d.Name)
+			continue
+		}
+		result[d.Name] = v
+	}
+	return result
+}
+
+// presentValues returns the observation's fields by name, leaving out those
+// still holding the placeholders set by observation.Zero
+func presentValues(w observation) map[string]interface{} {
+	values := map[string]interface{}{
+		"Lat":       w.Lat,
+		"Lon":       w.Lon,
+		"Timestamp": w.Timestamp,
+	}
+	set := func(name string, v interface{}, present bool) {
+		if present {
+			values[name] = v
+		}
+	}
+	set("Humidity", w.Humidity, w.Humidity >= 0)
+	set("Pressure", w.Pressure, w.Pressure > 0)
+	set("RainLastHour", w.RainLastHour, w.RainLastHour >= 0)
+	set("RainLast24Hours", w.RainLast24Hours, w.RainLast24Hours >= 0)
+	set("RainToday", w.RainToday, w.RainToday >= 0)
+	set("SolarRad", w.SolarRad, w.SolarRad >= 0)
+	set("Temp", w.Temp, w.Temp >= -99)
+	set("WindDir", w.WindDir, w.WindDir >= 0)
+	set("WindGust", w.WindGust, w.WindGust >= 0)
+	set("WindGustDir", w.WindGustDir, w.WindGustDir >= 0)
+	set("WindSpeed", w.WindSpeed, w.WindSpeed >= 0)
+	// TempF can be below the -99 the report carries, it is present with Temp
+	set("TempF", w.TempF, w.Temp >= -99)
+	set("HumidityPct", w.HumidityPct, w.HumidityPct >= 0)
+	set("SolarRadWm2", w.SolarRadWm2, w.SolarRadWm2 >= 0)
+	set("WindSpeedMph", w.WindSpeedMph, w.WindSpeedMph >= 0)
+	set("WindGustMph", w.WindGustMph, w.WindGustMph >= 0)
+	return values
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestPresentValuesTempBelowRange(t *testing.T) {
+	var w observation
+	w.Zero()
+	f := fieldMapping{Source: "temperature_F", Target: "temp"}
+	if err := f.apply(&w, -105.0); err != nil {
+		t.Fatal(err)
+	}
+
+	values := presentValues(w)
+	if values["Temp"] != -99 {
+		t.Errorf("Temp: got %v, want -99", values["Temp"])
+	}
+	if values["TempF"] != -105.0 {
+		t.Errorf("TempF: got %v, want -105", values["TempF"])
+	}
+
+	w.Zero()
+	if _, ok := presentValues(w)["TempF"]; ok {
+		t.Error("TempF present without a reading")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// fieldMapping maps an InfluxDB field onto a weather observation field
+type fieldMapping struct {
+	// Source is the InfluxDB field name
+	Source string
+	// Target names the observation field, see targets
+	Target string
+	// Unit is the unit the source is recorded in, empty if it is already in
+	// the target's APRS unit
+	Unit string
+	// Fn is the aggregation function used when influxdb.window is set,
+	// defaulting to influxdb.window_fn
+	Fn string
+	// MaxAge omits the field from the report when its latest point is older,
+	// so one dead sensor doesn't report zeros. Zero disables the check.
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// Query is "accumulated" for fields like rain that are totalled since
+	// local midnight by a separate query, empty for instantaneous values
+	Query string
+	// Missing is a raw source value treated as no reading, e.g. 0 from an
+	// anemometer that reads exactly 0 when iced up
+	Missing *float64
+	// Bucket or, for 1.x, RP in influxdb.db queries the field from somewhere
+	// other than influxdb.bucket or influxdb.rp, e.g. a downsampled retention
+	// policy for windowed fields
+	Bucket string
+	RP     string
+	// Measurement queries the field from a measurement other than
+	// influxdb.measurement, and Tags add to or override influxdb.filters for
+	// it, so fields can come from different sensors
+	Measurement string
+	Tags        map[string]string
+	// Threshold is how much the field must change since the last report sent
+	// to count as changed, see changed
+	Threshold float64
+}
+
+// errMissing is returned by apply for a field's Missing value
+var errMissing = errors.New("sentinel value treated as missing")
+
+// bucket returns the field's own bucket, empty for the default one
+func (f fieldMapping) bucket() string {
+	if f.Bucket != "" {
+		return f.Bucket
+	}
+	if f.RP != "" {
+		return viper.GetString("influxdb.db") + "/" + f.RP
+	}
+	return ""
+}
+
+// series identifies the bucket, measurement and tags the field is queried
+// from, empty when they are all the defaults
+func (f fieldMapping) series() string {
+	if f.bucket() == "" && f.Measurement == "" && len(f.Tags) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(f.Tags))
+	for tag, value := range f.Tags {
+		tags = append(tags, tag+"="+value)
+	}
+	sort.Strings(tags)
+	return f.bucket() + "|" + f.Measurement + "|" + strings.Join(tags, ",")
+}
+
+func (f fieldMapping) accumulated() bool {
+	return f.Query == "accumulated"
+}
+
+// stale reports whether a point recorded at t is too old to use
+func (f fieldMapping) stale(t time.Time) bool {
+	return f.MaxAge > 0 && time.Since(t) > f.MaxAge
+}
+
+// conversion converts a source value into a target's APRS unit
+type conversion func(float64) float64
+
+// target is a mappable observation field
+type target struct {
+	name string
+	// unit is the unit APRS expects
+	unit string
+	// units holds conversions from supported source units
+	units map[string]conversion
+	set   func(*observation, float64)
+	// has reports whether the field holds a reading rather than the
+	// placeholder set by observation.Zero
+	has func(observation) bool
+	// get returns the reading, unrounded where available
+	get func(observation) float64
+}
+
+var (
+	speedUnits = map[string]conversion{
+		"m/s":   func(v float64) float64 { return v * 2.23694 },
+		"km/h":  func(v float64) float64 { return v * 0.621371 },
+		"knots": func(v float64) float64 { return v * 1.15078 },
+	}
+	rainUnits = map[string]conversion{
+		"mm": func(v float64) float64 { return v / 25.4 },
+	}
+
+	targets = []target{
+		{
+			name: "temp",
+			unit: "F",
+			units: map[string]conversion{
+				"C": func(v float64) float64 { return v*1.8 + 32 },
+				"K": func(v float64) float64 { return (v-273.15)*1.8 + 32 },
+			},
+			set: func(w *observation, v float64) { w.TempF = v; w.Temp = clampTemp(v) },
+			has: func(w observation) bool { return w.Temp >= -99 },
+			get: func(w observation) float64 { return w.TempF },
+		},
+		{
+			name: "humidity",
+			unit: "%",
+			set:  func(w *observation, v float64) { w.HumidityPct = v; w.Humidity = int(math.Round(v)) },
+			has:  func(w observation) bool { return w.Humidity >= 0 },
+			get:  func(w observation) float64 { return w.HumidityPct },
+		},
+		{
+			name: "pressure",
+			unit: "mbar",
+			units: map[string]conversion{
+				"hPa":  func(v float64) float64 { return v },
+				"Pa":   func(v float64) float64 { return v / 100 },
+				"inHg": func(v float64) float64 { return v * 33.8639 },
+				"mmHg": func(v float64) float64 { return v * 1.33322 },
+			},
+			set: func(w *observation, v float64) { w.Pressure = v },
+			has: func(w observation) bool { return w.Pressure > 0 },
+			get: func(w observation) float64 { return w.Pressure },
+		},
+		{
+			name: "solar_rad",
+			unit: "W/m2",
+			units: map[string]conversion{
+				"lux": func(v float64) float64 { return v / 126 },
+			},
+			set: func(w *observation, v float64) { w.SolarRadWm2 = v; w.SolarRad = int(math.Round(v)) },
+			has: func(w observation) bool { return w.SolarRad >= 0 },
+			get: func(w observation) float64 { return w.SolarRadWm2 },
+		},
+		{
+			// a moving station's position, falling back to lat and lon
+			name: "lat",
+			unit: "deg",
+			set:  func(w *observation, v float64) { setCoord(&w.Lat, &w.hasLat, v, 90) },
+			has:  func(w observation) bool { return w.hasLat },
+			get:  func(w observation) float64 { return w.Lat },
+		},
+		{
+			name: "lon",
+			unit: "deg",
+			set:  func(w *observation, v float64) { setCoord(&w.Lon, &w.hasLon, v, 180) },
+			has:  func(w observation) bool { return w.hasLon },
+			get:  func(w observation) float64 { return w.Lon },
+		},
+		{
+			name: "wind_dir",
+			unit: "deg",
+			units: map[string]conversion{
+				"rad":        func(v float64) float64 { return v * 180 / math.Pi },
+				"normalized": func(v float64) float64 { return v * 360 },
+			},
+			set: func(w *observation, v float64) { w.WindDir = wrapDegrees(v) },
+			has: func(w observation) bool { return w.WindDir >= 0 },
+			get: func(w observation) float64 { return float64(w.WindDir) },
+		},
+		{
+			// comment only, the weather report has no gust direction
+			name: "wind_gust_dir",
+			unit: "deg",
+			units: map[string]conversion{
+				"rad":        func(v float64) float64 { return v * 180 / math.Pi },
+				"normalized": func(v float64) float64 { return v * 360 },
+			},
+			set: func(w *observation, v float64) { w.WindGustDir = wrapDegrees(v) },
+			has: func(w observation) bool { return w.WindGustDir >= 0 },
+			get: func(w observation) float64 { return float64(w.WindGustDir) },
+		},
+		{
+			name:  "wind_speed",
+			unit:  "mph",
+			units: speedUnits,
+			set:   func(w *observation, v float64) { w.WindSpeedMph = v; w.WindSpeed = int(math.Round(v)) },
+			has:   func(w observation) bool { return w.WindSpeed >= 0 },
+			get:   func(w observation) float64 { return w.WindSpeedMph },
+		},
+		{
+			name:  "wind_gust",
+			unit:  "mph",
+			units: speedUnits,
+			set:   func(w *observation, v float64) { w.WindGustMph = v; w.WindGust = int(math.Round(v)) },
+			has:   func(w observation) bool { return w.WindGust >= 0 },
+			get:   func(w observation) float64 { return w.WindGustMph },
+		},
+		{
+			name:  "rain_1h",
+			unit:  "in",
+			units: rainUnits,
+			set:   func(w *observation, v float64) { w.RainLastHour = v },
+			has:   func(w observation) bool { return w.RainLastHour >= 0 },
+			get:   func(w observation) float64 { return w.RainLastHour },
+		},
+		{
+			name:  "rain_24h",
+			unit:  "in",
+			units: rainUnits,
+			set:   func(w *observation, v float64) { w.RainLast24Hours = v },
+			has:   func(w observation) bool { return w.RainLast24Hours >= 0 },
+			get:   func(w observation) float64 { return w.RainLast24Hours },
+		},
+		{
+			name:  "rain_today",
+			unit:  "in",
+			units: rainUnits,
+			set:   func(w *observation, v float64) { w.RainToday = v },
+			has:   func(w observation) bool { return w.RainToday >= 0 },
+			get:   func(w observation) float64 { return w.RainToday },
+		},
+	}
+)
+
+// wrapDegrees rounds a direction to whole degrees in 0-359. Directions
+// outside 0-360 are wrapped too, but most likely mean the unit is wrong.
+func wrapDegrees(v float64) int {
+	if v < 0 || v > 360 {
+		log.Warnf("wind direction %.1f degrees out of range, check the unit", v)
+	}
+	d := int(math.Round(v)) % 360
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// setCoord sets a latitude or longitude in decimal degrees, ignoring values
+// beyond limit such as a GPS without a fix reporting garbage
+func setCoord(coord *float64, has *bool, v, limit float64) {
+	if math.Abs(v) > limit {
+		log.Warnf("position %f out of range, using the configured position", v)
+		return
+	}
+	*coord = v
+	*has = true
+}
+
+// clampTemp rounds a temperature to whole degrees F within the -99 to 999
+// the report can carry. Anything colder would otherwise collide with the -100
+// no reading placeholder and be sent as missing.
+func clampTemp(v float64) int {
+	t := int(math.Round(v))
+	if t < -99 {
+		log.Debugf("temperature %.1f F below the report's range, sending -99", v)
+		return -99
+	}
+	if t > 999 {
+		return 999
+	}
+	return t
+}
+
+// quantizeDegrees rounds a whole degree direction to the nearest step,
+// wrapping 360 back to 0
+func quantizeDegrees(d, step int) int {
+	if step <= 0 {
+		return d
+	}
+	q := int(math.Round(float64(d)/float64(step))) * step
+	return q % 360
+}
+
+// listFields prints every mappable target with its APRS unit and the source
+// units it can convert from
+func listFields(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tUNIT\tSOURCE UNITS")
+	for _, t := range targets {
+		units := make([]string, 0, len(t.units))
+		for u := range t.units {
+			units = append(units, u)
+		}
+		sort.Strings(units)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", t.name, t.unit, strings.Join(units, ", "))
+	}
+	tw.Flush()
+}
+
+func findTarget(name string) (target, bool) {
+	for _, t := range targets {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return target{}, false
+}
+
+// loadFieldMap reads and validates the field_map config, merged on top of
+// field_map_file if set. sources tells whether field_map was set by a config
+// file or is just the default.
+func loadFieldMap(sources configSources) ([]fieldMapping, error) {
+	var fields []fieldMapping
+	if err := viper.UnmarshalKey("field_map", &fields); err != nil {
+		return nil, err
+	}
+
+	if file := viper.GetString("field_map_file"); file != "" {
+		shared, err := readFieldMapFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if _, ok := sources["field_map"]; ok {
+			shared = mergeFieldMap(shared, fields)
+		}
+		fields = shared
+	}
+
+	for i, f := range fields {
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("field_map[%d]: %w", i, err)
+		}
+	}
+	return fields, nil
+}
+
+// readFieldMapFile reads a list of mappings, decoded like field_map
+func readFieldMapFile(file string) ([]fieldMapping, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML
+	var list []interface{}
+	if err := yaml.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	v.Set("field_map", list)
+	var fields []fieldMapping
+	err = v.UnmarshalKey("field_map", &fields)
+	return fields, err
+}
+
+// mergeFieldMap replaces mappings in base with the override of the same
+// target, appending overrides for new targets. One source can feed several
+// targets, so mappings are matched by target rather than source.
+func mergeFieldMap(base, overrides []fieldMapping) []fieldMapping {
+	merged := append([]fieldMapping(nil), base...)
+	for _, o := range overrides {
+		replaced := false
+		for i := range merged {
+			if merged[i].Target == o.Target {
+				merged[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
+
+func (f fieldMapping) validate() error {
+	if f.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if f.Query != "" && !f.accumulated() {
+		return fmt.Errorf("%s: query must be empty or accumulated, got %q", f.Source, f.Query)
+	}
+	if f.Bucket != "" && f.RP != "" {
+		return fmt.Errorf("%s: set bucket or rp, not both", f.Source)
+	}
+	if f.accumulated() && f.series() != "" {
+		return fmt.Errorf("%s: bucket, rp, measurement and tags aren't supported for accumulated fields", f.Source)
+	}
+	t, ok := findTarget(f.Target)
+	if !ok {
+		return fmt.Errorf("%s: unknown target %q", f.Source, f.Target)
+	}
+	if f.Unit != "" && f.Unit != t.unit {
+		if _, ok := t.units[f.Unit]; !ok {
+			return fmt.Errorf("%s: unsupported unit %q for %s", f.Source, f.Unit, t.name)
+		}
+	}
+	return nil
+}
+
+// apply converts a raw InfluxDB value and sets it on wxData
+func (f fieldMapping) apply(wxData *observation, value interface{}) error {
+	v, err := toFloat(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.Source, err)
+	}
+	if f.Missing != nil && v == *f.Missing {
+		return fmt.Errorf("%s: %w", f.Source, errMissing)
+	}
+	t, _ := findTarget(f.Target)
+	if convert, ok := t.units[f.Unit]; ok {
+		v = convert(v)
+	}
+	t.set(wxData, v)
+	return nil
+}
+
+// missingFields returns the sources of fields that have no reading in wxData
+func missingFields(fields []fieldMapping, wxData observation) []string {
+	var missing []string
+	for _, f := range fields {
+		t, _ := findTarget(f.Target)
+		if t.name == "lat" || t.name == "lon" {
+			// these fall back to the configured position
+			continue
+		}
+		if !t.has(wxData) {
+			missing = append(missing, f.Source)
+		}
+	}
+	return missing
+}
+
+// changed reports whether any field in cur moved by more than its threshold
+// since last, or has a reading in only one of them. Wind direction is
+// compared the short way round.
+func changed(fields []fieldMapping, last, cur observation) bool {
+	for _, f := range fields {
+		t, _ := findTarget(f.Target)
+		if t.has(last) != t.has(cur) {
+			return true
+		}
+		if !t.has(cur) {
+			continue
+		}
+		d := math.Abs(t.get(cur) - t.get(last))
+		if t.unit == "deg" && d > 180 {
+			d = 360 - d
+		}
+		if d > f.Threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// hasThresholds reports whether any field sets a change threshold
+func hasThresholds(fields []fieldMapping) bool {
+	for _, f := range fields {
+		if f.Threshold > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("unsupported value type %T", value)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPressureUnits(t *testing.T) {
+	cases := []struct {
+		unit  string
+		value float64
+	}{
+		{"inHg", 29.92},
+		{"mmHg", 760},
+		{"Pa", 101320},
+	}
+	for _, c := range cases {
+		var w observation
+		w.Zero()
+		f := fieldMapping{Source: "pressure", Target: "pressure", Unit: c.unit}
+		if err := f.apply(&w, c.value); err != nil {
+			t.Fatal(err)
+		}
+		if got := encodeWxFields(w.Wx); !strings.Contains(got, "b10132") {
+			t.Errorf("%g %s: got %s, want b10132", c.value, c.unit, got)
+		}
+	}
+}
+
+func TestMergeFieldMapSharedSource(t *testing.T) {
+	base := []fieldMapping{
+		{Source: "temperature_C", Target: "temp", Unit: "C"},
+		{Source: "wind_dir_deg", Target: "wind_dir"},
+		{Source: "wind_dir_deg", Target: "wind_gust_dir"},
+	}
+	overrides := []fieldMapping{
+		{Source: "wind_dir_deg", Target: "wind_dir", Unit: "rad"},
+		{Source: "humidity", Target: "humidity"},
+	}
+	want := []fieldMapping{
+		{Source: "temperature_C", Target: "temp", Unit: "C"},
+		{Source: "wind_dir_deg", Target: "wind_dir", Unit: "rad"},
+		{Source: "wind_dir_deg", Target: "wind_gust_dir"},
+		{Source: "humidity", Target: "humidity"},
+	}
+	if got := mergeFieldMap(base, overrides); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
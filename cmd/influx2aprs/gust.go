@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// gustTracker keeps the peak wind gust seen between beacons and its direction
+type gustTracker struct {
+	mu  sync.Mutex
+	max int
+	dir int
+	// warmup is how many samples are discarded after starting and after a
+	// failed query, since the first reading can be an outlier, and skip is how
+	// many are left to discard
+	warmup, skip int
+}
+
+func newGustTracker(warmup int) *gustTracker {
+	return &gustTracker{max: -1, dir: -1, warmup: warmup, skip: warmup}
+}
+
+// sample queries the latest gust at every interval and records it. Only the
+// wind_gust and wind_gust_dir mappings are queried.
+func (g *gustTracker) sample(src *influxSource, interval time.Duration) {
+	src = src.targeting("wind_gust", "wind_gust_dir")
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		wxData, err := src.fetch(interval, 0)
+		if err != nil {
+			log.WithError(err).Warn("Gust sample query error")
+			g.mu.Lock()
+			g.skip = g.warmup
+			g.mu.Unlock()
+			continue
+		}
+		g.observe(wxData.WindGust, wxData.WindGustDir)
+	}
+}
+
+func (g *gustTracker) observe(gust, dir int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.skip > 0 {
+		g.skip--
+		log.Debugf("discarding warm-up gust %d from %d", gust, dir)
+		return
+	}
+	if gust > g.max {
+		log.Debugf("new peak gust %d from %d", gust, dir)
+		g.max = gust
+		g.dir = dir
+	}
+}
+
+// peak returns the highest gust seen since the last reset and its direction,
+// or -1 for either
+func (g *gustTracker) peak() (int, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max, g.dir
+}
+
+// reset starts tracking a new peak, called after each beacon is sent
+func (g *gustTracker) reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.max = -1
+	g.dir = -1
+}
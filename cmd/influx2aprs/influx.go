@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// waitForInflux checks the server's /health endpoint, retrying with
+// exponential backoff until it passes or retries are exhausted
+func waitForInflux(client influxdb2.Client, retries int, backoff time.Duration) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = checkHealth(client)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries {
+			return err
+		}
+		log.WithError(err).Warnf("InfluxDB not healthy, retrying in %s", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func checkHealth(client influxdb2.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	health, err := client.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Status != domain.HealthCheckStatusPass {
+		msg := ""
+		if health.Message != nil {
+			msg = *health.Message
+		}
+		return fmt.Errorf("health check status %s: %s", health.Status, msg)
+	}
+	return nil
+}
+
+// influxSource queries weather observations from InfluxDB
+type influxSource struct {
+	queryAPI api.QueryAPI
+	fields   []fieldMapping
+	// custom replaces the built in query when set
+	custom *template.Template
+	// loc is where midnight is for accumulated fields
+	loc *time.Location
+	// columns are read from custom query results
+	columns columns
+	// retries is how many times a failed query is retried, waiting backoff
+	// and doubling it each time, within timeout for all of a fetch's queries
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+}
+
+// targeting returns a copy of s that only queries the mappings onto targets
+func (s *influxSource) targeting(targets ...string) *influxSource {
+	sub := *s
+	sub.fields = nil
+	for _, f := range s.fields {
+		for _, t := range targets {
+			if f.Target == t {
+				sub.fields = append(sub.fields, f)
+			}
+		}
+	}
+	return &sub
+}
+
+// queryParams are available to custom query templates
+type queryParams struct {
+	// Interval is the beacon interval as a Flux duration
+	Interval string
+	// Lookback is how far back the built in query would look
+	Lookback string
+	// Window is influxdb.window, empty if unset
+	Window string
+	// Bucket is influxdb.bucket or db/rp
+	Bucket string
+}
+
+// fetch queries the latest observation and maps the returned fields onto it.
+// Each field takes its newest value by that value's own timestamp, whatever
+// order records arrive in, and the observation's timestamp is the newest
+// instantaneous value used. Accumulated fields are merged in from a second
+// query covering the day so far.
+func (s *influxSource) fetch(interval, window time.Duration) (observation, error) {
+	if s.custom != nil {
+		query, err := s.query(interval, window)
+		if err != nil {
+			var wxData observation
+			wxData.Zero()
+			return wxData, err
+		}
+		// the custom query covers every field, whatever its series
+		return s.fetchQuery(s.columns, seriesQuery{fields: s.fields, query: query})
+	}
+	var queries []seriesQuery
+	for _, series := range append([]string{""}, s.fieldSeries()...) {
+		if fields := s.seriesFields(series); len(fields) > 0 {
+			queries = append(queries, seriesQuery{
+				fields: fields,
+				query:  s.buildQuery(interval, window, series),
+			})
+		}
+	}
+	return s.fetchQuery(defaultColumns, queries...)
+}
+
+// fetchLast is fetch for the most recent point of each field up to maxAge
+// old, regardless of the interval and window. Fields with their own series
+// aren't included.
+func (s *influxSource) fetchLast(maxAge time.Duration) (observation, error) {
+	var queries []seriesQuery
+	if fields := s.seriesFields(""); len(fields) > 0 {
+		queries = append(queries, seriesQuery{fields: fields, query: s.lastQuery(maxAge)})
+	}
+	return s.fetchQuery(defaultColumns, queries...)
+}
+
+// seriesQuery is a query and the fields its results are mapped onto, so
+// fields of the same name in different series don't mix
+type seriesQuery struct {
+	fields []fieldMapping
+	query  string
+}
+
+// fetchQuery runs each query for instantaneous fields, reading cols, then the
+// accumulated query if there are accumulated fields
+func (s *influxSource) fetchQuery(cols columns, queries ...seriesQuery) (observation, error) {
+	var wxData observation
+	wxData.Zero()
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	for _, q := range queries {
+		points := make(map[string]point)
+		if err := s.run(ctx, q.query, cols, points); err != nil {
+			return wxData, err
+		}
+		s.apply(points, q.fields, false, &wxData)
+	}
+
+	for _, f := range s.fields {
+		if f.accumulated() {
+			points := make(map[string]point)
+			err := s.run(ctx, s.accumulatedQuery(time.Now()), defaultColumns, points)
+			s.apply(points, s.fields, true, &wxData)
+			return wxData, err
+		}
+	}
+	return wxData, nil
+}
+
+// columns names the result columns holding each record's field name, value
+// and time
+type columns struct {
+	Field string
+	Value string
+	Time  string
+}
+
+// defaultColumns are what Flux returns and the built in queries read
+var defaultColumns = columns{Field: "_field", Value: "_value", Time: "_time"}
+
+// point is a field's value and when it was recorded
+type point struct {
+	time  time.Time
+	value interface{}
+}
+
+// run executes query, retrying failures while there's time left in ctx
+func (s *influxSource) run(ctx context.Context, query string, cols columns, points map[string]point) error {
+	log.Debugf("query: %s", query)
+
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := s.runOnce(ctx, query, cols, points)
+		if err == nil || attempt >= s.retries || ctx.Err() != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			log.WithError(err).Warn("Query failed, no time left to retry")
+			return err
+		}
+		log.WithError(err).Warnf("Query failed, retrying in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// runOnce executes query and keeps the newest point of each field in points,
+// so the result doesn't depend on the order records are returned in, see
+// mergeRecord
+func (s *influxSource) runOnce(ctx context.Context, query string, cols columns, points map[string]point) error {
+	result, err := s.queryAPI.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	for result.Next() {
+		record := result.Record()
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			log.WithFields(recordTags(record)).Debugf("record %s=%v at %s", record.Field(), record.Value(), record.Time())
+		}
+		mergeRecord(points, record, cols)
+	}
+	return result.Err()
+}
+
+// mergeRecord keeps each field of record in points unless points already
+// holds a newer value for it
+func mergeRecord(points map[string]point, record *query.FluxRecord, cols columns) {
+	t := recordTime(record, cols)
+	for field, value := range recordValues(record, cols) {
+		if p, ok := points[field]; !ok || t.After(p.time) {
+			points[field] = point{time: t, value: value}
+		}
+	}
+}
+
+// apply maps points onto wxData using either the instantaneous or the
+// accumulated mappings of fields. The observation's timestamp is the newest
+// instantaneous point used.
+func (s *influxSource) apply(points map[string]point, fields []fieldMapping, accumulated bool, wxData *observation) {
+	for _, f := range fields {
+		p, ok := points[f.Source]
+		if !ok || f.accumulated() != accumulated {
+			continue
+		}
+		if !accumulated && f.stale(p.time) {
+			log.Warnf("Omitting %s, last point at %s is older than %s", f.Source, p.time, f.MaxAge)
+			continue
+		}
+		if err := f.apply(wxData, p.value); err != nil {
+			if errors.Is(err, errMissing) {
+				log.WithError(err).Debug("Omitting field")
+			} else {
+				log.WithError(err).Warn("Skipping field")
+			}
+			continue
+		}
+		if !accumulated && p.time.After(wxData.Timestamp) {
+			wxData.Timestamp = p.time
+		}
+	}
+}
+
+// recordValues returns the field values in record by field name. Records
+// normally hold one field in the field and value columns, but a pivoted query
+// like |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+// has no field column and holds each field in a column named after it.
+func recordValues(record *query.FluxRecord, cols columns) map[string]interface{} {
+	if field, ok := record.Values()[cols.Field]; ok {
+		return map[string]interface{}{fmt.Sprint(field): record.ValueByKey(cols.Value)}
+	}
+	values := make(map[string]interface{})
+	for k, v := range recordTags(record) {
+		if v != nil && k != cols.Time {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// recordTime returns the time in record's time column, zero if it has none
+func recordTime(record *query.FluxRecord, cols columns) time.Time {
+	t, _ := record.ValueByKey(cols.Time).(time.Time)
+	return t
+}
+
+// recordTags returns the record's series tags, including the measurement, so
+// mis-merges from overly broad filters can be traced to a series
+func recordTags(record *query.FluxRecord) logrus.Fields {
+	tags := logrus.Fields{}
+	for k, v := range record.Values() {
+		switch k {
+		case "_value", "_field", "_time", "_start", "_stop", "result", "table":
+			continue
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// accumulatedQuery returns the Flux query for accumulated fields, covering
+// local midnight until now. Midnight comes from time.Date in the configured
+// location so DST transitions don't shift it.
+func (s *influxSource) accumulatedQuery(now time.Time) string {
+	now = now.In(s.loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.loc)
+
+	var match []string
+	for _, f := range s.fields {
+		if f.accumulated() {
+			match = append(match, fmt.Sprintf(`r._field == "%s"`, f.Source))
+		}
+	}
+
+	return fmt.Sprintf(
+		`from(bucket: "%s")
+		|> range(start: %s)
+		|> filter(fn: (r) => %s and (%s))
+		|> %s()`,
+		bucket(),
+		midnight.Format(time.RFC3339),
+		predicate(),
+		strings.Join(match, " or "),
+		viper.GetString("influxdb.accumulate_fn"),
+	)
+}
+
+// lastQuery returns the Flux query for the last point of each field up to
+// maxAge old
+func (s *influxSource) lastQuery(maxAge time.Duration) string {
+	from, pred := s.selection("")
+	return fmt.Sprintf(
+		`from(bucket: "%s")
+		|> range(start: -%s)
+		|> filter(fn: (r) => %s)
+		|> last()`,
+		from,
+		maxAge,
+		pred,
+	)
+}
+
+// query executes the custom query template
+func (s *influxSource) query(interval, window time.Duration) (string, error) {
+	p := queryParams{
+		Interval: interval.String(),
+		Lookback: lookback(interval, window).String(),
+		Bucket:   bucket(),
+	}
+	if window > 0 {
+		p.Window = window.String()
+	}
+	var b bytes.Buffer
+	err := s.custom.Execute(&b, p)
+	return b.String(), err
+}
+
+// bucket returns influxdb.bucket, or for 1.x the db/rp pair it maps to
+func bucket() string {
+	if viper.GetString("influxdb.bucket") != "" {
+		return viper.GetString("influxdb.bucket")
+	}
+	return viper.GetString("influxdb.db") + "/" + viper.GetString("influxdb.rp")
+}
+
+// checkInfluxConfig validates the combination of 1.x and 2.x settings
+func checkInfluxConfig() error {
+	org := viper.GetString("influxdb.org")
+	token := viper.GetString("influxdb.token")
+	if viper.GetString("influxdb.bucket") != "" && org == "" {
+		return fmt.Errorf("influxdb.org is required with influxdb.bucket")
+	}
+	if org != "" && token == "" {
+		return fmt.Errorf("influxdb.token is required with influxdb.org")
+	}
+
+	username := viper.GetString("influxdb.username")
+	if viper.GetString("influxdb.password") != "" && username == "" {
+		return fmt.Errorf("influxdb.username is required with influxdb.password")
+	}
+	if username != "" && token != "" {
+		return fmt.Errorf("configure either influxdb.token or influxdb.username, not both")
+	}
+	if username != "" && viper.GetString("influxdb.bucket") != "" {
+		return fmt.Errorf("influxdb.username is for 1.x, use influxdb.token with influxdb.bucket")
+	}
+	return nil
+}
+
+// newInfluxClient returns a client authenticating with the configured token,
+// or with HTTP basic auth for 1.x servers behind a username and password
+func newInfluxClient() influxdb2.Client {
+	url := viper.GetString("influxdb.url")
+	if viper.GetString("influxdb.username") == "" {
+		return influxdb2.NewClient(url, viper.GetString("influxdb.token"))
+	}
+
+	opts := influxdb2.DefaultOptions().SetHTTPClient(&http.Client{
+		Timeout: 20 * time.Second,
+		Transport: &basicAuth{
+			username: viper.GetString("influxdb.username"),
+			password: viper.GetString("influxdb.password"),
+			next:     http.DefaultTransport,
+		},
+	})
+	return influxdb2.NewClientWithOptions(url, "", opts)
+}
+
+// basicAuth adds HTTP basic auth to every request
+type basicAuth struct {
+	username, password string
+	next               http.RoundTripper
+}
+
+func (b *basicAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(b.username, b.password)
+	return b.next.RoundTrip(req)
+}
+
+// predicate matches the configured measurement, station id and tag filters
+func predicate() string {
+	return seriesPredicate(viper.GetString("influxdb.measurement"), viper.GetStringMapString("influxdb.filters"))
+}
+
+// seriesPredicate matches measurement, the configured station id unless the
+// filters set their own and the tag filters
+func seriesPredicate(measurement string, filters map[string]string) string {
+	preds := []string{fmt.Sprintf(`r._measurement == "%s"`, measurement)}
+	if _, ok := filters["id"]; !ok && viper.GetString("influxdb.station") != "" {
+		preds = append(preds, fmt.Sprintf(`r.id == "%s"`, viper.GetString("influxdb.station")))
+	}
+
+	tags := make([]string, 0, len(filters))
+	for tag := range filters {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		preds = append(preds, fmt.Sprintf(`r["%s"] == "%s"`, tag, filters[tag]))
+	}
+	return strings.Join(preds, " and ")
+}
+
+func lookback(interval, window time.Duration) time.Duration {
+	if window > interval*2 {
+		return window
+	}
+	return interval * 2
+}
+
+// fieldSeries returns the series fields are queried from other than the
+// default one, in the order they are first used
+func (s *influxSource) fieldSeries() []string {
+	var series []string
+	seen := make(map[string]bool)
+	for _, f := range s.fields {
+		if k := f.series(); k != "" && !seen[k] {
+			seen[k] = true
+			series = append(series, k)
+		}
+	}
+	return series
+}
+
+// seriesFields returns the instantaneous fields queried from series
+func (s *influxSource) seriesFields(series string) []fieldMapping {
+	var fields []fieldMapping
+	for _, f := range s.fields {
+		if f.series() == series && !f.accumulated() {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// selection returns the bucket and predicate the fields of series are
+// queried with, which matches only their sources so unmapped fields, perhaps
+// strings that can't be aggregated, are never read. series must have fields.
+func (s *influxSource) selection(series string) (string, string) {
+	fields := s.seriesFields(series)
+	var match []string
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		if !seen[f.Source] {
+			seen[f.Source] = true
+			match = append(match, fmt.Sprintf(`r._field == "%s"`, f.Source))
+		}
+	}
+	fieldPred := " and (" + strings.Join(match, " or ") + ")"
+	if series == "" {
+		return bucket(), predicate() + fieldPred
+	}
+
+	f := fields[0]
+	from := f.bucket()
+	if from == "" {
+		from = bucket()
+	}
+	measurement := f.Measurement
+	if measurement == "" {
+		measurement = viper.GetString("influxdb.measurement")
+	}
+	filters := viper.GetStringMapString("influxdb.filters")
+	for tag, value := range f.Tags {
+		filters[tag] = value
+	}
+	return from, seriesPredicate(measurement, filters) + fieldPred
+}
+
+// buildQuery returns the Flux query for the fields of series, see
+// selection. Without a window the last raw point of each field is returned,
+// otherwise points are aggregated into windows and the most recent window of
+// each field is returned.
+func (s *influxSource) buildQuery(interval, window time.Duration, series string) string {
+	from, pred := s.selection(series)
+
+	data := fmt.Sprintf(
+		`from(bucket: "%s")
+		|> range(start: -%s)
+		|> filter(fn: (r) => %s)`,
+		from,
+		lookback(interval, window),
+		pred,
+	)
+
+	if window == 0 {
+		return data + `
+		|> last()`
+	}
+
+	aggregate := func(fn string) string {
+		return fmt.Sprintf(`
+		|> aggregateWindow(every: %s, fn: %s, createEmpty: false)
+		|> last()`, window, fn)
+	}
+
+	// group fields by aggregation function, everything else gets the default
+	// function
+	fields := make(map[string][]string)
+	var fns []string
+	for _, f := range s.fields {
+		if f.Fn == "" || f.accumulated() || f.series() != series {
+			continue
+		}
+		if _, ok := fields[f.Fn]; !ok {
+			fns = append(fns, f.Fn)
+		}
+		fields[f.Fn] = append(fields[f.Fn], f.Source)
+	}
+
+	if len(fns) == 0 {
+		return data + aggregate(viper.GetString("influxdb.window_fn"))
+	}
+
+	var tables, others []string
+	for _, fn := range fns {
+		var match []string
+		for _, f := range fields[fn] {
+			match = append(match, fmt.Sprintf(`r._field == "%s"`, f))
+			others = append(others, fmt.Sprintf(`r._field != "%s"`, f))
+		}
+		tables = append(tables, fmt.Sprintf(`data
+		|> filter(fn: (r) => %s)%s`, strings.Join(match, " or "), aggregate(fn)))
+	}
+	tables = append(tables, fmt.Sprintf(`data
+		|> filter(fn: (r) => %s)%s`, strings.Join(others, " and "), aggregate(viper.GetString("influxdb.window_fn"))))
+
+	return fmt.Sprintf("data = %s\n\nunion(tables: [\n\t%s\n])", data, strings.Join(tables, ",\n\t"))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
+)
+
+func TestMergeRecordOutOfOrder(t *testing.T) {
+	t0 := time.Date(2024, 3, 4, 5, 0, 0, 0, time.UTC)
+	record := func(field string, value float64, minutes int) *query.FluxRecord {
+		return query.NewFluxRecord(0, map[string]interface{}{
+			"_field": field,
+			"_value": value,
+			"_time":  t0.Add(time.Duration(minutes) * time.Minute),
+		})
+	}
+
+	points := make(map[string]point)
+	for _, r := range []*query.FluxRecord{
+		record("temperature_C", 20, 5),
+		record("temperature_C", 10, 0),
+		record("humidity", 40, 1),
+		record("temperature_C", 15, 3),
+		record("humidity", 60, 2),
+	} {
+		mergeRecord(points, r, defaultColumns)
+	}
+
+	src := &influxSource{fields: []fieldMapping{
+		{Source: "temperature_C", Target: "temp", Unit: "C"},
+		{Source: "humidity", Target: "humidity"},
+	}}
+	var w observation
+	w.Zero()
+	src.apply(points, src.fields, false, &w)
+
+	if w.Temp != 68 {
+		t.Errorf("temp: got %d, want the newest 20 C as 68 F", w.Temp)
+	}
+	if w.Humidity != 60 {
+		t.Errorf("humidity: got %d, want the newest 60", w.Humidity)
+	}
+	if want := t0.Add(5 * time.Minute); !w.Timestamp.Equal(want) {
+		t.Errorf("timestamp: got %s, want the newest point's %s", w.Timestamp, want)
+	}
+}
+
+func TestAccumulatedQueryMidnightDST(t *testing.T) {
+	loadTestConfig(t, nil)
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	src := &influxSource{
+		fields: []fieldMapping{{Source: "rain_mm", Target: "rain_today", Unit: "mm", Query: "accumulated"}},
+		loc:    loc,
+	}
+
+	cases := []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		// clocks go from 02:00 EST to 03:00 EDT
+		{"spring forward before", time.Date(2024, 3, 10, 6, 30, 0, 0, time.UTC), "2024-03-10T00:00:00-05:00"},
+		{"spring forward after", time.Date(2024, 3, 10, 7, 30, 0, 0, time.UTC), "2024-03-10T00:00:00-05:00"},
+		{"spring forward late", time.Date(2024, 3, 11, 3, 59, 0, 0, time.UTC), "2024-03-10T00:00:00-05:00"},
+		// clocks go from 02:00 EDT back to 01:00 EST
+		{"fall back before", time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC), "2024-11-03T00:00:00-04:00"},
+		{"fall back after", time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC), "2024-11-03T00:00:00-04:00"},
+		{"fall back late", time.Date(2024, 11, 4, 4, 59, 0, 0, time.UTC), "2024-11-03T00:00:00-04:00"},
+		{"day after fall back", time.Date(2024, 11, 4, 5, 0, 0, 0, time.UTC), "2024-11-04T00:00:00-05:00"},
+	}
+	for _, c := range cases {
+		q := src.accumulatedQuery(c.now)
+		if !strings.Contains(q, "range(start: "+c.want+")") {
+			t.Errorf("%s: want midnight %s in\n%s", c.name, c.want, q)
+		}
+	}
+}
+
+func TestTargetingGust(t *testing.T) {
+	loadTestConfig(t, nil)
+	fields, err := loadFieldMap(configSources{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields = append(fields, fieldMapping{Source: "rain_mm", Target: "rain_today", Unit: "mm", Query: "accumulated"})
+	fake := &fakeQueryAPI{csv: wh24CSV(time.Now(), 21.5)}
+	src := (&influxSource{queryAPI: fake, fields: fields, loc: time.UTC}).targeting("wind_gust", "wind_gust_dir")
+
+	w, err := src.fetch(time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.queries) != 1 {
+		t.Fatalf("got %d queries, want only the gust query: %q", len(fake.queries), fake.queries)
+	}
+	if q := fake.queries[0]; !strings.Contains(q, `(r._field == "wind_max_m_s")`) {
+		t.Errorf("query doesn't select only the gust field:\n%s", q)
+	}
+	if w.WindGust != 10 || w.WindSpeed != -1 || w.Temp != -100 {
+		t.Errorf("got gust %d, speed %d, temp %d, want only the gust", w.WindGust, w.WindSpeed, w.Temp)
+	}
+}
+
+func TestBuildQuerySelectsMappedFields(t *testing.T) {
+	loadTestConfig(t, nil)
+	src := &influxSource{fields: []fieldMapping{
+		{Source: "temperature_C", Target: "temp", Unit: "C"},
+		{Source: "wind_dir_deg", Target: "wind_dir"},
+		{Source: "wind_dir_deg", Target: "wind_gust_dir"},
+		{Source: "wind_max_m_s", Target: "wind_gust", Unit: "m/s", Fn: "max"},
+		{Source: "rain_mm", Target: "rain_today", Unit: "mm", Query: "accumulated"},
+		{Source: "pressure", Target: "pressure", Measurement: "BME280"},
+	}}
+
+	want := `(r._field == "temperature_C" or r._field == "wind_dir_deg" or r._field == "wind_max_m_s")`
+	for _, window := range []time.Duration{0, 5 * time.Minute} {
+		q := src.buildQuery(10*time.Minute, window, "")
+		if !strings.Contains(q, want) {
+			t.Errorf("window %s: query doesn't select only the mapped fields %s:\n%s", window, want, q)
+		}
+		if strings.Contains(q, "rain_mm") || strings.Contains(q, "pressure") {
+			t.Errorf("window %s: query selects accumulated or other series fields:\n%s", window, q)
+		}
+	}
+}
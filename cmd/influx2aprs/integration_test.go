@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acobaugh/aprs-tools/internal/aprsistest"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig resets the global config to the defaults with settings
+// applied on top, as main would after reading a config file
+func loadTestConfig(t *testing.T, settings map[string]interface{}) *viper.Viper {
+	t.Helper()
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBuffer(defaultConfig)); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+	return viper.GetViper()
+}
+
+// fakeQueryAPI stands in for InfluxDB, answering every query with csv, an
+// annotated CSV query response. When err is set, queries after the first
+// succeed fail with it.
+type fakeQueryAPI struct {
+	api.QueryAPI
+	csv     string
+	err     error
+	succeed int
+	queries []string
+}
+
+func (f *fakeQueryAPI) Query(ctx context.Context, query string) (*api.QueryTableResult, error) {
+	f.queries = append(f.queries, query)
+	if f.err != nil && len(f.queries) > f.succeed {
+		return nil, f.err
+	}
+	return api.NewQueryTableResult(io.NopCloser(strings.NewReader(f.csv))), nil
+}
+
+// wh24CSV is one reading of the default field_map's sensor at t, as an
+// annotated CSV query response
+func wh24CSV(t time.Time, tempC float64) string {
+	var b strings.Builder
+	b.WriteString(`#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,id
+`)
+	for _, f := range []struct {
+		field string
+		value float64
+	}{
+		{"temperature_C", tempC},
+		{"humidity", 50},
+		{"wind_dir_deg", 90},
+		{"wind_avg_m_s", 2.235},
+		{"wind_max_m_s", 4.47},
+	} {
+		fmt.Fprintf(&b, ",,0,%s,%s,%s,%g,%s,Fineoffset-WH24,10\n",
+			t.Add(-20*time.Minute).Format(time.RFC3339), t.Format(time.RFC3339), t.Format(time.RFC3339), f.value, f.field)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// TestSendIteration runs one tick of the main loop against a fake InfluxDB
+// and a fake APRS-IS server
+func TestSendIteration(t *testing.T) {
+	for _, persistent := range []bool{false, true} {
+		srv := aprsistest.NewServer()
+		l, fake := newSendingTestLoop(t, map[string]interface{}{
+			"ssid":              13,
+			"comment":           "test {{.Temp}}F",
+			"aprsis.server":     srv.Addr,
+			"aprsis.persistent": persistent,
+		})
+		fake.csv = wh24CSV(time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC), 21.5)
+
+		if code, stop := l.tick(); code != exitSent || stop {
+			t.Fatalf("persistent=%t: got exit code %d, stop %t", persistent, code, stop)
+		}
+
+		want := "N0CALL-13>APRS,TCPIP*:@040506z4030.00N/07715.00W_090/005g010t071r...p...P...h50b.....test 71F"
+		got := srv.WaitFrames(1, 5*time.Second)
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("persistent=%t: got frames %q, want %q", persistent, got, want)
+		}
+		wantLogin := "user N0CALL-13 pass 13023 vers influx2aprs " + version
+		if logins := srv.Logins(); len(logins) != 1 || logins[0] != wantLogin {
+			t.Errorf("persistent=%t: got logins %q, want %q", persistent, logins, wantLogin)
+		}
+		// a held connection stays open until the server closes it
+		srv.Close()
+	}
+}
+
+func TestLoginSoftwareVersion(t *testing.T) {
+	srv := aprsistest.NewServer()
+	defer srv.Close()
+	l, fake := newSendingTestLoop(t, map[string]interface{}{
+		"aprsis.server":    srv.Addr,
+		"software.name":    "mystation",
+		"software.version": "2.0-test",
+	})
+	fake.csv = wh24CSV(time.Now(), 21.5)
+
+	if code, _ := l.tick(); code != exitSent {
+		t.Fatalf("got exit code %d, want %d", code, exitSent)
+	}
+	want := "user N0CALL-13 pass 13023 vers mystation 2.0-test"
+	if logins := srv.Logins(); len(logins) != 1 || logins[0] != want {
+		t.Errorf("got logins %q, want %q", logins, want)
+	}
+}
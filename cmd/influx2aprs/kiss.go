@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/acobaugh/aprs"
+)
+
+// KISS framing, see The KISS TNC: A simple Host-to-TNC communications protocol
+const (
+	kissFend    = 0xc0
+	kissFesc    = 0xdb
+	kissTfend   = 0xdc
+	kissTfesc   = 0xdd
+	kissCmdData = 0x00
+)
+
+// kissFrame returns f as an AX.25 UI frame in a KISS data frame for port 0
+func kissFrame(f aprs.Frame) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{kissFend, kissCmdData})
+	for _, c := range f.Bytes() {
+		switch c {
+		case kissFend:
+			b.Write([]byte{kissFesc, kissTfend})
+		case kissFesc:
+			b.Write([]byte{kissFesc, kissTfesc})
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(kissFend)
+	return b.Bytes()
+}
+
+// sendKISS sends f to the KISS over TCP TNC at addr, such as Direwolf. This is
+// aprs.Frame.SendKISS with a connect timeout and write errors returned.
+func sendKISS(f aprs.Frame, addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(kissFrame(f))
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/acobaugh/aprs"
+)
+
+func TestKissFrame(t *testing.T) {
+	src, err := parseAddr("N0CALL-13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := parseAddr("APRS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := parsePath([]string{"WIDE2-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		text string
+		info []byte
+	}{
+		{"plain", ">test", []byte(">test")},
+		{"escaped", ">\xc0\xdb", []byte{'>', kissFesc, kissTfend, kissFesc, kissTfesc}},
+	}
+	for _, c := range cases {
+		f := aprs.Frame{Dst: dst, Src: src, Path: path, Text: c.text}
+
+		want := []byte{kissFend, kissCmdData}
+		// addresses are shifted left one bit, with the SSID byte 0x60 | SSID<<1
+		// and the last address flagged in bit 0
+		want = append(want, 'A'<<1, 'P'<<1, 'R'<<1, 'S'<<1, ' '<<1, ' '<<1, 0x60)
+		want = append(want, 'N'<<1, '0'<<1, 'C'<<1, 'A'<<1, 'L'<<1, 'L'<<1, 0x60|13<<1)
+		want = append(want, 'W'<<1, 'I'<<1, 'D'<<1, 'E'<<1, '2'<<1, ' '<<1, 0x60|1<<1|1)
+		// UI frame, no layer 3 protocol
+		want = append(want, 0x03, 0xf0)
+		want = append(want, c.info...)
+		want = append(want, kissFend)
+
+		if got := kissFrame(f); !bytes.Equal(got, want) {
+			t.Errorf("%s: got % x, want % x", c.name, got, want)
+		}
+	}
+}
+
+func TestKissStationLimits(t *testing.T) {
+	cases := []struct {
+		call    string
+		ssid    int
+		wantErr bool
+	}{
+		{"N0CALL", 15, false},
+		{"N0CALL", 0, false},
+		{"AB1CDEF", 13, true},
+		{"AB1CDEFGH", 13, true},
+		{"N0CALL", 16, true},
+		{"N0CALL", -1, true},
+	}
+	for _, c := range cases {
+		v := loadTestConfig(t, map[string]interface{}{
+			"callsign":  c.call,
+			"ssid":      c.ssid,
+			"transport": "kiss",
+		})
+		_, err := newOutput(v, time.Minute)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s-%d: got error %v, want error %t", c.call, c.ssid, err, c.wantErr)
+		}
+	}
+}
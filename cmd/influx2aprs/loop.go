@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// loop holds the main loop's config and the state it carries between ticks,
+// so one tick can be run against fake outputs in tests
+type loop struct {
+	src    *influxSource
+	outs   []*output
+	fields []fieldMapping
+	seq    *seqCounter
+	stats  *metrics
+	// gusts is nil unless gust_sample_interval is set
+	gusts *gustTracker
+
+	mode             string
+	interval, window time.Duration
+	// fallback is fallback_max_age when fallback_to_last is set
+	fallback  time.Duration
+	keepalive time.Duration
+
+	// maxFailures consecutive failures stop the loop, 0 retries forever.
+	// Failures within grace of started aren't counted.
+	maxFailures int
+	grace       time.Duration
+	started     time.Time
+	failures    int
+
+	lastTime, lastSent time.Time
+	// lastReport is the last weather report sent when change thresholds are
+	// configured
+	lastReport *observation
+}
+
+func (l *loop) keepaliveDue() bool {
+	return l.keepalive > 0 && time.Since(l.lastSent) >= l.keepalive
+}
+
+// failed counts a failed tick, reporting whether max_consecutive_failures
+// is reached
+func (l *loop) failed() bool {
+	l.stats.failures++
+	if time.Since(l.started) < l.grace {
+		log.Debug("Failure within startup_grace, not counted")
+		return false
+	}
+	l.failures++
+	if l.maxFailures > 0 && l.failures >= l.maxFailures {
+		log.Errorf("%d consecutive failures, exiting", l.failures)
+		return true
+	}
+	return false
+}
+
+// tick queries the latest weather and sends it to every output, or flushes
+// their queues and sends a keepalive when due if there is nothing new. It
+// returns the exit code describing the tick, and whether the loop should
+// stop because of consecutive failures.
+func (l *loop) tick() (code int, stop bool) {
+	// a query failing after others succeeded leaves a partial observation,
+	// which is dropped so the tick counts as a query failure
+	wxData, err := l.src.fetch(l.interval, l.window)
+	if err != nil {
+		log.WithError(err).Error("Query error")
+		wxData.Zero()
+	}
+	if err == nil && wxData.Timestamp.IsZero() && l.fallback > 0 {
+		log.Debugf("no data, falling back to the last point within %s", l.fallback)
+		wxData, err = l.src.fetchLast(l.fallback)
+		if err != nil {
+			log.WithError(err).Error("Fallback query error")
+			wxData.Zero()
+		}
+	}
+	if l.mode == "strict" && !wxData.Timestamp.IsZero() {
+		if missing := missingFields(l.fields, wxData); len(missing) > 0 {
+			log.Warnf("Not sending partial report in strict mode, missing %s", strings.Join(missing, ", "))
+			wxData.Zero()
+		}
+	}
+
+	// no new weather is decided separately from whether a keepalive is due,
+	// so a sensor stuck on one timestamp still gets a keepalive
+	newData := true
+	switch {
+	case wxData.Timestamp.IsZero():
+		log.Debug("empty wxData")
+		newData = false
+	case wxData.Timestamp == l.lastTime:
+		log.Debugf("skipping. timestamp=%s lastTime=%s", wxData.Timestamp, l.lastTime)
+		newData = false
+	case l.lastReport != nil && !changed(l.fields, *l.lastReport, wxData) && !l.keepaliveDue():
+		// unchanged readings go out as a full report once keepalive is due
+		log.Debug("skipping, no field changed by more than its threshold")
+		newData = false
+	}
+	if !newData {
+		return l.idle(err)
+	}
+	l.lastTime = wxData.Timestamp
+
+	if l.gusts != nil {
+		if peak, dir := l.gusts.peak(); peak > wxData.WindGust {
+			wxData.WindGust = peak
+			wxData.WindGustMph = float64(peak)
+			wxData.WindGustDir = dir
+		}
+	}
+	log.Debugf("wxData: %#v", wxData)
+
+	// the tick only succeeds if every output sent, failed frames are
+	// queued per output
+	sent := true
+	for _, o := range l.outs {
+		frames, err := o.frames(wxData, o.comment)
+		if err != nil {
+			log.WithError(err).Errorf("Failed to render comment for %s", o.sender)
+			sent = false
+			continue
+		}
+		if _, err := o.queue.flush(o); err != nil {
+			o.queue.push(wxData.Timestamp, frames...)
+			sent = false
+			continue
+		}
+		if n, err := o.sendAll(frames); err != nil {
+			o.queue.push(wxData.Timestamp, frames[n:]...)
+			sent = false
+		}
+	}
+	if !sent {
+		return exitSendFailed, l.failed()
+	}
+	l.lastSent = time.Now()
+	l.failures = 0
+	l.seq.advance()
+	l.stats.report(wxData)
+	if hasThresholds(l.fields) {
+		l.lastReport = &wxData
+	}
+	if l.gusts != nil {
+		l.gusts.reset()
+	}
+	return exitSent, false
+}
+
+// idle handles a tick without new weather, queryErr being the query's
+// error: queued frames are flushed and a keepalive sent when due
+func (l *loop) idle(queryErr error) (code int, stop bool) {
+	var flushErr error
+	flushed := 0
+	for _, o := range l.outs {
+		n, err := o.queue.flush(o)
+		flushed += n
+		if err != nil {
+			flushErr = err
+		}
+	}
+	// only a successful send resets the failure count, a tick without new
+	// data says nothing about whether sending works
+	code = exitNoData
+	switch {
+	case queryErr != nil:
+		code = exitQueryFailed
+		stop = l.failed()
+	case flushErr != nil:
+		code = exitSendFailed
+		stop = l.failed()
+	case flushed > 0:
+		l.failures = 0
+	}
+	if stop {
+		return code, stop
+	}
+
+	// beacon without weather so the station is still seen
+	if l.keepaliveDue() {
+		var noData observation
+		noData.Zero()
+		sent := false
+		for _, o := range l.outs {
+			frames, err := o.frames(noData, o.noData)
+			if err != nil {
+				log.WithError(err).Error("Failed to render comment_nodata")
+				continue
+			}
+			if _, err := o.sendAll(frames); err == nil {
+				sent = true
+				l.stats.keepalive()
+			}
+		}
+		if sent {
+			l.lastSent = time.Now()
+			l.seq.advance()
+			if code == exitNoData {
+				l.failures = 0
+			}
+		}
+	}
+	return code, false
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLoop builds a loop like main does from the defaults with settings
+// applied, querying a fake InfluxDB and sending with a recordingSender
+func newTestLoop(t *testing.T, settings map[string]interface{}) (*loop, *fakeQueryAPI, *recordingSender) {
+	t.Helper()
+	l, fake := newSendingTestLoop(t, settings)
+	sender := &recordingSender{}
+	l.outs[0].sender = sender
+	return l, fake, sender
+}
+
+// newSendingTestLoop is newTestLoop sending with the configured transport
+func newSendingTestLoop(t *testing.T, settings map[string]interface{}) (*loop, *fakeQueryAPI) {
+	t.Helper()
+	all := map[string]interface{}{
+		"callsign": "N0CALL",
+		"lat":      40.5,
+		"lon":      -77.25,
+		"comment":  "{{.Temp}}F",
+	}
+	for k, v := range settings {
+		all[k] = v
+	}
+	v := loadTestConfig(t, all)
+	setSoftware()
+
+	fields, err := loadFieldMap(configSources{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOutput(v, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeQueryAPI{}
+	l := &loop{
+		src:         &influxSource{queryAPI: fake, fields: fields, loc: time.UTC},
+		outs:        []*output{o},
+		fields:      fields,
+		seq:         o.seq,
+		stats:       &metrics{},
+		mode:        v.GetString("mode"),
+		interval:    time.Minute,
+		maxFailures: v.GetInt("max_consecutive_failures"),
+	}
+	return l, fake
+}
+
+// sentComments returns the comment after the weather fields of each
+// weather report sent
+func sentComments(s *recordingSender) []string {
+	var comments []string
+	for _, text := range s.sent {
+		comments = append(comments, text[strings.LastIndex(text, ".")+1:])
+	}
+	return comments
+}
+
+func TestTickDedup(t *testing.T) {
+	l, fake, sender := newTestLoop(t, nil)
+	now := time.Now().Truncate(time.Second)
+
+	fake.csv = wh24CSV(now.Add(-time.Minute), 21.5)
+	if code, _ := l.tick(); code != exitSent {
+		t.Fatalf("first tick: got exit code %d, want %d", code, exitSent)
+	}
+	if code, _ := l.tick(); code != exitNoData {
+		t.Fatalf("same timestamp: got exit code %d, want %d", code, exitNoData)
+	}
+	fake.csv = wh24CSV(now, 22)
+	if code, _ := l.tick(); code != exitSent {
+		t.Fatalf("new timestamp: got exit code %d, want %d", code, exitSent)
+	}
+
+	if got, want := sentComments(sender), []string{"71F", "72F"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if l.seq.n != 2 || l.stats.reports != 2 {
+		t.Errorf("got seq %d and %d reports, want 2", l.seq.n, l.stats.reports)
+	}
+}
+
+// TestTickRetry checks that frames that failed to send are queued and sent
+// oldest first once the sender is back, ahead of the next tick's frames
+func TestTickRetry(t *testing.T) {
+	l, fake, sender := newTestLoop(t, map[string]interface{}{
+		"queue.size":    10,
+		"queue.max_age": "1h",
+	})
+	now := time.Now().Truncate(time.Second)
+
+	sender.down = true
+	fake.csv = wh24CSV(now.Add(-2*time.Minute), 20)
+	if code, _ := l.tick(); code != exitSendFailed {
+		t.Fatalf("got exit code %d, want %d", code, exitSendFailed)
+	}
+	fake.csv = wh24CSV(now.Add(-time.Minute), 21)
+	l.tick()
+
+	sender.down = false
+	fake.csv = wh24CSV(now, 22)
+	if code, _ := l.tick(); code != exitSent {
+		t.Fatalf("got exit code %d, want %d", code, exitSent)
+	}
+	if got, want := sentComments(sender), []string{"68F", "70F", "72F"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if n := len(l.outs[0].queue.frames); n != 0 {
+		t.Errorf("%d frames left queued", n)
+	}
+}
+
+func TestTickKeepalive(t *testing.T) {
+	l, fake, sender := newTestLoop(t, nil)
+	l.keepalive = time.Hour
+
+	fake.csv = wh24CSV(time.Now(), 21.5)
+	l.tick()
+	l.tick()
+	if len(sender.sent) != 1 {
+		t.Fatalf("keepalive sent before it was due: %q", sender.sent)
+	}
+
+	l.lastSent = time.Now().Add(-time.Hour)
+	if code, _ := l.tick(); code != exitNoData {
+		t.Fatalf("got exit code %d, want %d", code, exitNoData)
+	}
+	if len(sender.sent) != 2 || !strings.HasSuffix(sender.sent[1], "WX sensor offline") {
+		t.Fatalf("got %q, want a keepalive", sender.sent)
+	}
+	if l.stats.keepalives != 1 || l.seq.n != 2 {
+		t.Errorf("got %d keepalives and seq %d, want 1 and 2", l.stats.keepalives, l.seq.n)
+	}
+}
+
+func TestTickBreaker(t *testing.T) {
+	l, fake, sender := newTestLoop(t, map[string]interface{}{
+		"max_consecutive_failures": 2,
+	})
+	now := time.Now().Truncate(time.Second)
+	sender.down = true
+
+	fake.csv = wh24CSV(now.Add(-time.Minute), 21.5)
+	if code, stop := l.tick(); code != exitSendFailed || stop {
+		t.Fatalf("first failure: got %d, %t", code, stop)
+	}
+	fake.csv = wh24CSV(now, 21.5)
+	if code, stop := l.tick(); code != exitSendFailed || !stop {
+		t.Fatalf("second failure: got %d, %t, want %d and stop", code, stop, exitSendFailed)
+	}
+}
+
+// TestTickBreakerSlowSensor checks that ticks without new data in between
+// failed sends don't reset the failure count, as with a sensor updating
+// slower than interval and no queue
+func TestTickBreakerSlowSensor(t *testing.T) {
+	l, fake, sender := newTestLoop(t, map[string]interface{}{
+		"max_consecutive_failures": 2,
+	})
+	now := time.Now().Truncate(time.Second)
+	sender.down = true
+
+	fake.csv = wh24CSV(now.Add(-time.Minute), 21.5)
+	l.tick()
+	if code, stop := l.tick(); code != exitNoData || stop {
+		t.Fatalf("no new data: got %d, %t", code, stop)
+	}
+	fake.csv = wh24CSV(now, 21.5)
+	if code, stop := l.tick(); code != exitSendFailed || !stop {
+		t.Fatalf("second failure: got %d, %t, want %d and stop", code, stop, exitSendFailed)
+	}
+}
+
+func TestTickQueryFailed(t *testing.T) {
+	l, fake, sender := newTestLoop(t, map[string]interface{}{
+		"max_consecutive_failures": 1,
+	})
+	fake.err = errors.New("connection refused")
+
+	code, stop := l.tick()
+	if code != exitQueryFailed || !stop {
+		t.Errorf("got %d, %t, want %d and stop", code, stop, exitQueryFailed)
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("sent %q", sender.sent)
+	}
+}
+
+// TestTickPartialQuery checks that an observation is dropped when a later
+// query fails, here the accumulated rain query after the instantaneous one
+func TestTickPartialQuery(t *testing.T) {
+	l, fake, sender := newTestLoop(t, nil)
+	rain := fieldMapping{Source: "rain_mm", Target: "rain_today", Unit: "mm", Query: "accumulated"}
+	l.fields = append(l.fields, rain)
+	l.src.fields = l.fields
+	fake.csv = wh24CSV(time.Now(), 21.5)
+	fake.err = errors.New("timeout")
+	fake.succeed = 1
+
+	if code, _ := l.tick(); code != exitQueryFailed {
+		t.Errorf("got exit code %d, want %d", code, exitQueryFailed)
+	}
+	if len(fake.queries) != 2 {
+		t.Errorf("got %d queries, want 2", len(fake.queries))
+	}
+	if len(sender.sent) != 0 || l.failures != 1 {
+		t.Errorf("sent %q with %d failures, want nothing sent and 1 failure", sender.sent, l.failures)
+	}
+}
+
+func TestTickKeepaliveSplit(t *testing.T) {
+	l, fake, sender := newTestLoop(t, map[string]interface{}{
+		"packet_style": "split",
+	})
+	l.keepalive = time.Hour
+
+	fake.csv = wh24CSV(time.Now(), 21.5)
+	l.tick()
+	if len(sender.sent) != 2 {
+		t.Fatalf("got %q, want a position and a weather report", sender.sent)
+	}
+
+	l.lastSent = time.Now().Add(-time.Hour)
+	l.tick()
+	want := "!4030.00N/07715.00W_WX sensor offline"
+	if len(sender.sent) != 3 || sender.sent[2] != want {
+		t.Errorf("got %q, want only the keepalive position %q", sender.sent[2:], want)
+	}
+}
+
+// TestTickUDPErrors checks that UDP send errors are only logged
+func TestTickUDPErrors(t *testing.T) {
+	l, fake := newSendingTestLoop(t, map[string]interface{}{
+		"transport":                "udp",
+		"udp.host":                 "127.0.0.1",
+		"udp.port":                 "99999",
+		"queue.size":               10,
+		"max_consecutive_failures": 1,
+	})
+	fake.csv = wh24CSV(time.Now(), 21.5)
+
+	if code, stop := l.tick(); code != exitSent || stop {
+		t.Errorf("got %d, %t, want %d", code, stop, exitSent)
+	}
+	if n := len(l.outs[0].queue.frames); n != 0 {
+		t.Errorf("%d frames queued", n)
+	}
+}
@@ -2,52 +2,361 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"fmt"
-	"math"
 	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/acobaugh/aprs"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
 )
 
+// version is reported in the APRS-IS login, set with
+// -ldflags "-X main.version=..."
+var version = "0.1"
+
 var (
-	fConfig      string
+	fConfig      []string
 	fDebug       bool
 	fOnce        bool
+	fCount       int
 	fPrintConfig bool
+	fPrintFrame  bool
+	fListFields  bool
+	fExplain     bool
+	fEffective   bool
 
 	defaultConfig = []byte(`
+# upper cased, letters and digits only
 callsign: ""
 ssid: 13
+# destination and path of every frame, upper cased
+frame:
+  tocall: APRS
+  path: [TCPIP*]
 interval: 10m
 lat: ""
 lon: ""
+# decimal digits of minutes kept in the transmitted position (0-2)
+position_digits: 2
+# when set, wind is sampled at this interval between beacons and the peak gust
+# seen is reported at the next beacon
+gust_sample_interval: ""
+# gust samples discarded after starting and after a failed sample query,
+# since the first reading can be an outlier. Beacons still report the
+# readings they query themselves, including the first one on startup.
+gust_warmup_samples: 0
+# text/template executed against each observation, e.g. {{.Temp}}. In weather
+# reports this is the free text after the weather fields and may be empty.
+# TempF, HumidityPct, SolarRadWm2, WindSpeedMph and WindGustMph hold the
+# unrounded values, e.g. {{printf "%.1f" .TempF}}.
+# {{.Seq}} counts beacons sent, for spotting lost packets.
 comment: github.com/acobaugh/aprs-tools
+# comments rotated through in place of comment, one per beacon sent and
+# wrapping around, e.g. club info, website and net schedule. The position in
+# the list follows {{.Seq}}, so it continues across restarts with seq_file.
+comments: []
+# comments used instead of comment when their condition holds, first match
+# wins. when renders true or false over the fields present this tick and
+# derived values, e.g.
+#   - {when: '{{lt .Temp 32}}', text: 'Freeze warning {{.Temp}}F'}
+#   - {when: '{{gt .Temp 95}}', text: 'Heat advisory {{.Temp}}F'}
+# lt, le, gt and ge compare whole numbers and floats alike, eq and ne need the
+# same type. Pressure, the rain fields, TempF, HumidityPct, SolarRadWm2,
+# WindSpeedMph, WindGustMph and derived values are floats, e.g.
+# {{eq .RainToday 0.0}}, the other fields whole numbers.
+comment_rules: []
+# static text added before and after the rendered comment
+comment_prefix: ""
+comment_suffix: ""
+# weather report comments, including prefix and suffix, are limited to this
+# many characters, 0 for no limit. The rendered comment is cut to make room
+# so the prefix and suffix, e.g. a website, are kept whole. Status reports are
+# always limited to 62 and messages are split instead.
+comment_max_length: 43
+# raw text appended to the information field of weather reports, or of the
+# position packet with packet_style split, after the comment, for APRS data
+# extensions this tool doesn't model, e.g. a DAO precision extension !W52!.
+# It isn't validated beyond being one line that fits in the 256 character
+# field, so use at your own risk.
+info_suffix: ""
+# when set, a beacon without weather is sent if nothing has been sent for this
+# long, e.g. while the sensor is offline or keeps reporting the same timestamp.
+# comment_nodata is used as its comment.
+keepalive: ""
+comment_nodata: WX sensor offline
+# named values computed from the observation, available to the comment as
+# {{.Derived.<name>}}. expr is a template rendering a number using the math
+# functions add, sub, mul, div, pow, min, max, sqrt, exp, log, abs and round,
+# and may refer to derived values defined before it. Fields missing from this
+# tick's data are left out, so a value depending on them is skipped, e.g.
+#   - name: temp_c
+#     expr: '{{sub .Temp 32 | mul 0.5556}}'
+derived: []
+# lenient sends whatever fields are available, strict only sends reports with
+# every field_map field present, e.g. for official-quality stations. Fields
+# omitted by max_age or missing count as not present, and a partial report in
+# strict mode is treated like no data, so keepalive still applies.
+mode: lenient
+# wx sends a weather report, status sends only the rendered comment as a
+# status report for stations whose position is beaconed elsewhere and message
+# sends it as APRS messages to message.to, split into numbered lines if too
+# long for one message
+packet: wx
+# combined sends each weather report as one packet with the position and
+# comment. split sends a position packet with the comment followed by a
+# positionless weather report, which is two packets per interval but leaves
+# the comment the full 43 characters of a position and the weather report
+# shorter. Aggregators such as aprs.fi and CWOP tie the two together by
+# callsign, so the weather shows at the last position the station beaconed.
+# timestamp.format doesn't apply to positionless reports, which are always
+# stamped MMDDHHMM. Keepalives send only the position packet.
+packet_style: combined
+# symbol shown at the station's position, from the primary (/) or alternate
+# (\) table. overlay is a digit or capital letter shown on an alternate table
+# symbol, e.g. table \ code _ overlay W. Combined weather reports require
+# the weather station code _, split position packets may use any.
+symbol:
+  table: /
+  code: _
+  overlay: ""
+# weather reports are stamped with the observation time (record) by default,
+# or with the send time (now). format is dhm (DDHHMMz) or hms (HHMMSSh), both
+# in UTC.
+timestamp:
+  source: record
+  format: dhm
+message:
+  # addressee callsign with an optional SSID, e.g. N0CALL-5, upper cased and
+  # at most 9 characters
+  to: ""
+  # number messages so the recipient acks them. Acks aren't waited for and
+  # unacked messages aren't retried.
+  ack: false
+# skip sending, e.g. during antenna work. This is re-read from the config on
+# SIGHUP, so sends can be paused and resumed without restarting.
+pause: false
+# file the {{.Seq}} count is saved to so it continues across restarts
+seq_file: ""
+# exit after this many failed iterations in a row, 0 for unlimited, with 3 if
+# the last one failed to send or 4 if its query failed, as --once does
+max_consecutive_failures: 0
+# failures this soon after startup don't count towards
+# max_consecutive_failures, giving InfluxDB and the network time to come up.
+# Defaults to one interval.
+startup_grace: ""
+# weather frames that fail to send are retried on later ticks, up to size
+# frames. Frames observed longer than max_age ago (default one interval) are
+# discarded instead of sending outdated weather.
+queue:
+  size: 0
+  max_age: ""
+# software name and version sent in the APRS-IS login, version defaults to the
+# build version
+software:
+  name: influx2aprs
+  version: ""
+# cwop sends to the Citizen Weather Observer Program instead, using its
+# server and an unverified login. callsign is the CWOP station ID (e.g. CW1234)
+# and ssid is ignored.
+cwop: false
+aprsis:
+  server: rotate.aprs.net:14580
+  # generated from the callsign when empty
+  passcode: ""
+  # connect timeout for each address the server resolves to
+  connect_timeout: 10s
+  # keep one connection open instead of logging in for every frame, sending
+  # a # comment line every keepalive (e.g. 5m) so it isn't dropped as idle
+  persistent: false
+  keepalive: ""
+  # reconnect a held connection when the server sends nothing for this long,
+  # servers send a # comment line about every 20s
+  quiet_timeout: 2m
+# aprsis sends to APRS-IS, udp sends each frame as a TNC2 line in a datagram
+# and only logs errors, since nothing confirms delivery anyway. kiss sends
+# each frame as AX.25 to a KISS over TCP TNC such as Direwolf for
+# transmission over RF, where frame.path should be e.g. [WIDE2-1]. AX.25
+# limits the callsign to 6 characters and ssid to 0-15.
+transport: aprsis
+udp:
+  host: localhost
+  port: 14580
+kiss:
+  host: localhost
+  port: 8001
+  connect_timeout: 10s
+# logs always go to stderr. syslog also sends them to the local syslog daemon
+# with facility and tag, or only the frames sent when frames_only is set.
+log:
+  syslog: false
+  facility: daemon
+  tag: influx2aprs
+  frames_only: false
+# additional outputs sent each interval from the same data. Each entry
+# overrides the station, frame, packet, comment, queue and transport settings
+# above for that output, e.g. a second network with its own server, callsign
+# and comment in metric units:
+#   - transport: udp
+#     udp: {host: example.net, port: 14580}
+#     comment: '{{printf "%.1f" .Derived.temp_c}}C'
+# A tick only counts as sent once every output has sent.
+outputs: []
+# when url is set, counters and the last report's values are pushed to this
+# Prometheus Pushgateway as job before exiting, e.g. for --once runs from cron
+pushgateway:
+  url: ""
+  job: influx2aprs
 influxdb:
   url: http://localhost:8086
+  # InfluxDB 2.x and Cloud: org, token and bucket. When bucket is set it is
+  # queried instead of db/rp.
+  org: ""
+  token: ""
+  bucket: ""
+  # InfluxDB 1.x: database and retention policy, queried as bucket "db/rp".
+  # username and password use HTTP basic auth and can't be combined with token.
   db: rtl_433_wx
-  measurement: Fineoffset-WH24
   rp: autogen
+  username: ""
+  password: ""
+  measurement: Fineoffset-WH24
+  # matched against the id tag, leave empty for schemas without one
   station: 10
+  # additional tag filters ANDed into the query, e.g. {channel: "1"}. Tag
+  # names are case insensitive in config and are matched lower cased.
+  filters: {}
+  # health check retries at startup, the backoff doubles after each attempt
+  startup_retries: 5
+  startup_backoff: 5s
+  # retries of a failed query within an interval, separate from sending,
+  # which queues failed frames instead. The backoff doubles after each
+  # attempt, and all of an interval's queries including retries must finish
+  # within query_timeout, which defaults to the interval.
+  retries: 0
+  retry_backoff: 2s
+  query_timeout: ""
+  # when set, aggregate points server-side into windows of this size
+  window: ""
+  window_fn: mean
+  # Flux function applied to accumulated fields since midnight, spread gives
+  # the increase of a counter such as rtl_433's rain_mm
+  accumulate_fn: spread
+  # Flux text/template used instead of the built in query, with {{.Interval}},
+  # {{.Lookback}}, {{.Window}} and {{.Bucket}} available. Results are mapped via field_map.
+  # Pivoted results with a column per field, e.g. from
+  # pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value"),
+  # are detected and mapped by column name.
+  query: ""
+  # columns names the result columns query returns the field name, value and
+  # time in, for schemas that rename them
+  columns:
+    field: _field
+    value: _value
+    time: _time
+# when the query returns nothing, fall back to the last point of each field
+# up to fallback_max_age old so slow sensors keep a presence without widening
+# the window. This uses measurement, station and filters, not query, and
+# field_map max_age still applies.
+fallback_to_last: false
+fallback_max_age: 6h
+# time zone used for midnight, e.g. America/New_York
+timezone: Local
+# round wind direction to the nearest this many degrees, 0 to disable. This is
+# applied to the final direction right before the packet is built, after unit
+# conversion, so any smoothing sees the unrounded values.
+wind_dir_quantize: 0
+# omit solar radiation while the sun is below solar_min_elevation degrees at
+# the station's position and the report's time, so 0 W/m2 is only sent in
+# daylight, where it points at a stuck sensor rather than night
+solar_daylight_only: false
+solar_min_elevation: 0
+# InfluxDB fields mapped onto the weather report. Targets and their units:
+#   temp (F: C, K), humidity (%), pressure (mbar: hPa, Pa, inHg, mmHg),
+#   solar_rad (W/m2: lux), wind_dir (deg: rad, normalized 0-1), wind_speed and wind_gust (mph: m/s,
+#   km/h, knots), rain_1h, rain_24h and rain_today (in: mm)
+#   wind_gust_dir (deg: rad, normalized) is comment only as {{.WindGustDir}},
+#   the weather report has no slot for it
+#   lat and lon (decimal degrees) report a moving station's position, e.g.
+#   from GPS, with the lat and lon settings used when either is missing
+# fn overrides influxdb.window_fn for that field, max_age (e.g. 30m) omits the
+# field when its latest point is older. query: accumulated pulls the field from
+# a second query covering local midnight until now, e.g.
+#   - {source: rain_mm, target: rain_today, unit: mm, query: accumulated}
+# missing is a raw value that means no reading and omits the field, e.g.
+#   - {source: wind_avg_m_s, target: wind_speed, unit: m/s, missing: 0}
+# bucket, or rp within influxdb.db, queries an instantaneous field from
+# elsewhere, e.g. a downsampled retention policy for windowed fields:
+#   - {source: wind_avg_m_s, target: wind_speed, unit: m/s, rp: rp_1h}
+# measurement and tags query an instantaneous field from another measurement
+# and adjust influxdb.filters for it, with tags.id replacing influxdb.station,
+# e.g. pressure from an indoor sensor:
+#   - {source: pressure_hPa, target: pressure, measurement: BME280, tags: {id: "3"}}
+# Each combination of these gets its own query, so a source name can appear
+# in more than one. They use the built in query only, not influxdb.query or
+# fallback_to_last.
+# threshold, in the target's unit, holds back new reports until at least one
+# field changed by more than its threshold since the last report sent. Fields
+# without one count any change, and with no thresholds every new timestamp is
+# sent. Pair with keepalive, which sends the unchanged readings as a normal
+# report once due, so the station is still seen during stable conditions, e.g.
+#   - {source: temperature_C, target: temp, unit: C, threshold: 1}
+# field_map_file is a YAML or JSON list of mappings shared between stations,
+# used instead of the default field_map. Mappings in a config file's field_map
+# then replace the file's mapping with the same target or are added to it.
+field_map_file: ""
+field_map:
+  - {source: temperature_C, target: temp, unit: C}
+  - {source: humidity, target: humidity}
+  - {source: light_lux, target: solar_rad, unit: lux}
+  - {source: wind_dir_deg, target: wind_dir}
+  - {source: wind_max_m_s, target: wind_gust, unit: m/s, fn: max}
+  - {source: wind_avg_m_s, target: wind_speed, unit: m/s}
 `)
 )
 
 func init() {
-	flag.StringVarP(&fConfig, "config", "c", "", "config file")
+	flag.StringSliceVarP(&fConfig, "config", "c", nil, "config file or directory, may be repeated with later files overriding earlier ones")
 	flag.BoolVarP(&fDebug, "debug", "d", false, "enable debug output")
-	flag.BoolVarP(&fOnce, "once", "o", false, "run once then exit")
+	flag.BoolVarP(&fOnce, "once", "o", false, "run once then exit 0 if a report was sent, 2 for no new data, 3 if sending failed or 4 if the query failed")
+	flag.IntVarP(&fCount, "count", "n", 0, "exit after sending this many weather reports, failed sends and keepalives don't count")
 	flag.BoolVarP(&fPrintConfig, "print-config", "P", false, "print default config then exit")
+	flag.BoolVarP(&fPrintFrame, "print-frame", "F", false, "query once, print the frame that would be sent then exit")
+	flag.BoolVarP(&fListFields, "list-fields", "L", false, "list field_map targets and units then exit")
+	flag.BoolVar(&fEffective, "print-effective-config", false, "print the merged config from defaults, files and env then exit")
+	flag.BoolVarP(&fExplain, "explain-config", "E", false, "print each config key's effective value and where it was set then exit")
 	flag.Parse()
 }
 
+var log = logrus.StandardLogger()
+
+// exit codes for --once and max_consecutive_failures. Config errors exit 1
+// via log.Fatal.
+const (
+	exitSent        = 0
+	exitNoData      = 2
+	exitSendFailed  = 3
+	exitQueryFailed = 4
+)
+
+// frameLog additionally logs each frame sent when set, see setupSyslog
+var frameLog *logrus.Logger
+
 func main() {
-	log := logrus.StandardLogger()
+	if fListFields {
+		listFields(os.Stdout)
+		os.Exit(0)
+	}
+
+	if fPrintConfig {
+		fmt.Print(string(bytes.TrimPrefix(defaultConfig, []byte("\n"))))
+		os.Exit(0)
+	}
 
 	viper.SetConfigType("yaml")
 
@@ -57,26 +366,47 @@ func main() {
 		log.WithError(err).Fatal("failed to parse default config")
 	}
 
-	// read config file from given path
-	if fConfig != "" {
-		viper.SetConfigFile(fConfig)
+	// read config files from given paths, in order
+	files, err := configFiles(fConfig)
+	if err != nil {
+		log.WithError(err).Fatal("fatal error config file")
+	}
+	sources := configSources{}
+	for _, file := range files {
+		viper.SetConfigFile(file)
 		err := viper.MergeInConfig()
 		if err != nil {
-			log.WithError(err).Fatal("fatal error config file")
+			log.WithError(err).Fatalf("fatal error config file %s", file)
+		}
+		if err := sources.merge(file); err != nil {
+			log.WithError(err).Fatalf("fatal error config file %s", file)
 		}
 	}
 
 	// allow env vars to override config
 	viper.AutomaticEnv()
 
+	if fExplain {
+		explainConfig(os.Stdout, sources)
+		os.Exit(0)
+	}
+
+	// keep stdout clean for piping, only errors are logged
+	if fPrintFrame {
+		fDebug = false
+		log.SetLevel(logrus.ErrorLevel)
+	}
+
 	// print parsed config
-	if fDebug {
-		c := viper.AllSettings()
-		b, err := yaml.Marshal(c)
+	if fDebug || fEffective {
+		b, err := yaml.Marshal(maskedSettings())
 		if err != nil {
-			log.WithError(err).Fatal("failed to marshal default config to yaml")
+			log.WithError(err).Fatal("failed to marshal config to yaml")
 		}
 		fmt.Print(string(b))
+		if fEffective {
+			os.Exit(0)
+		}
 	}
 
 	if fDebug {
@@ -87,92 +417,269 @@ func main() {
 		})
 	}
 
+	if err := setupSyslog(); err != nil {
+		log.WithError(err).Fatal("Failed to set up syslog")
+	}
+
 	interval, err := time.ParseDuration(viper.GetString("interval"))
 	if err != nil {
 		log.WithError(err).Fatal("Failed to parse interval")
 	}
 
-	influx := influxdb2.NewClient(viper.GetString("influxdb.url"), "")
-	queryAPI := influx.QueryAPI("")
+	var keepalive time.Duration
+	if viper.GetString("keepalive") != "" {
+		keepalive, err = time.ParseDuration(viper.GetString("keepalive"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse keepalive")
+		}
+	}
 
-	var lastTime time.Time
-	ticker := time.NewTicker(interval)
-LOOP:
-	for ; true; <-ticker.C {
-		var wxData aprs.Wx
-		wxData.Zero()
-		wxData.Lat = viper.GetFloat64("lat")
-		wxData.Lon = viper.GetFloat64("lon")
-		wxData.Type = viper.GetString("comment")
-
-		result, err := queryAPI.Query(
-			context.TODO(), fmt.Sprintf(
-				`from(bucket: "%s/%s")
-				|> range(start: -%s)
-				|> filter(fn: (r) => r._measurement == "%s" and r.id == "%s")
-				|> limit(n:1)`,
-				viper.GetString("influxdb.db"),
-				viper.GetString("influxdb.rp"),
-				interval*2,
-				viper.GetString("influxdb.measurement"),
-				viper.GetString("influxdb.station"),
-			),
-		)
-
-		if err == nil {
-			for result.Next() {
-				if wxData.Timestamp.IsZero() {
-					wxData.Timestamp = result.Record().Time()
-					if wxData.Timestamp == lastTime || wxData.Timestamp.IsZero() {
-						log.Debugf("skipping. timestamp=%s lastTime=%s", wxData.Timestamp, lastTime)
-						continue LOOP
-					}
-					lastTime = wxData.Timestamp
-				}
+	mode := viper.GetString("mode")
+	if mode != "strict" && mode != "lenient" {
+		log.Fatalf("mode must be strict or lenient, got %q", mode)
+	}
 
-				switch result.Record().Field() {
-				case "temperature_C":
-					wxData.Temp = int(math.Round(result.Record().Value().(float64)*1.8 + 32))
-				case "humidity":
-					wxData.Humidity = int(math.Round(result.Record().Value().(float64)))
-				case "light_lux":
-					wxData.SolarRad = int(math.Round(result.Record().Value().(float64)) / 126) // lux / 126 = W/m^2
-				case "wind_dir_deg":
-					wxData.WindDir = int(math.Round(result.Record().Value().(float64)))
-				case "wind_max_m_s":
-					wxData.WindGust = int(math.Round(result.Record().Value().(float64) * 2.23694))
-				case "wind_avg_m_s":
-					wxData.WindSpeed = int(math.Round(result.Record().Value().(float64) * 2.23694))
-				}
-			}
+	setSoftware()
 
-			if result.Err() != nil {
-				log.WithError(result.Err()).Error("Result error")
-			}
-		} else {
-			log.WithError(err).Error("Query error")
+	out, err := newOutput(viper.GetViper(), interval)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid output config")
+	}
+	outs := []*output{out}
+	profiles, err := outputProfiles()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid outputs")
+	}
+	for i, v := range profiles {
+		o, err := newOutput(v, interval)
+		if err != nil {
+			log.WithError(err).Fatalf("Invalid outputs[%d]", i)
 		}
-		if !wxData.Timestamp.IsZero() {
-			log.Debugf("wxData: %#v", wxData)
+		outs = append(outs, o)
+	}
+	seq, err := loadSeq(viper.GetString("seq_file"))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load seq_file")
+	}
+	for _, o := range outs {
+		o.seq = seq
+	}
+
+	var window time.Duration
+	if viper.GetString("influxdb.window") != "" {
+		window, err = time.ParseDuration(viper.GetString("influxdb.window"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse influxdb.window")
+		}
+	}
+
+	fields, err := loadFieldMap(sources)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid field_map")
+	}
+
+	loc, err := time.LoadLocation(viper.GetString("timezone"))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load timezone")
+	}
 
-			f := aprs.Frame{
-				Dst:  aprs.Addr{Call: "APRS"},
-				Src:  aprs.Addr{Call: viper.GetString("callsign"), SSID: viper.GetInt("ssid")},
-				Path: aprs.Path{aprs.Addr{Call: "TCPIP", Repeated: true}},
-				Text: wxData.String(),
+	if err := checkInfluxConfig(); err != nil {
+		log.WithError(err).Fatal("Invalid influxdb config")
+	}
+	influx := newInfluxClient()
+	src := &influxSource{
+		queryAPI: influx.QueryAPI(viper.GetString("influxdb.org")),
+		fields:   fields,
+		loc:      loc,
+		retries:  viper.GetInt("influxdb.retries"),
+		timeout:  interval,
+	}
+	src.backoff, err = time.ParseDuration(viper.GetString("influxdb.retry_backoff"))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to parse influxdb.retry_backoff")
+	}
+	if viper.GetString("influxdb.query_timeout") != "" {
+		src.timeout, err = time.ParseDuration(viper.GetString("influxdb.query_timeout"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse influxdb.query_timeout")
+		}
+	}
+	if viper.GetString("influxdb.query") != "" {
+		src.custom, err = template.New("query").Parse(viper.GetString("influxdb.query"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse influxdb.query")
+		}
+		src.columns = defaultColumns
+		if err := viper.UnmarshalKey("influxdb.columns", &src.columns); err != nil {
+			log.WithError(err).Fatal("Invalid influxdb.columns")
+		}
+	}
+
+	var fallback time.Duration
+	if viper.GetBool("fallback_to_last") {
+		fallback, err = time.ParseDuration(viper.GetString("fallback_max_age"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse fallback_max_age")
+		}
+	}
+
+	// render a single frame to stdout without sending it
+	if fPrintFrame {
+		wxData, err := src.fetch(interval, window)
+		if err != nil {
+			log.WithError(err).Fatal("Query error")
+		}
+		if wxData.Timestamp.IsZero() && fallback > 0 {
+			wxData, err = src.fetchLast(fallback)
+			if err != nil {
+				log.WithError(err).Fatal("Fallback query error")
+			}
+		}
+		if wxData.Timestamp.IsZero() {
+			log.Fatal("No data")
+		}
+		if mode == "strict" {
+			if missing := missingFields(fields, wxData); len(missing) > 0 {
+				log.Fatalf("Missing %s in strict mode", strings.Join(missing, ", "))
 			}
-			err := f.SendIS("tcp://rotate.aprs.net:14580", int(aprs.GenPass(f.Src.Call)))
+		}
+		for _, o := range outs {
+			frames, err := o.frames(wxData, o.comment)
 			if err != nil {
-				log.WithError(err).Error("APRS-IS error")
-				continue
+				log.WithError(err).Fatal("Failed to render comment")
+			}
+			for _, f := range frames {
+				fmt.Println(f)
+			}
+		}
+		os.Exit(0)
+	}
+
+	backoff, err := time.ParseDuration(viper.GetString("influxdb.startup_backoff"))
+	if err != nil {
+		log.WithError(err).Fatal("Failed to parse influxdb.startup_backoff")
+	}
+	err = waitForInflux(influx, viper.GetInt("influxdb.startup_retries"), backoff)
+	if err != nil {
+		log.WithError(err).Error("InfluxDB health check failed, continuing anyway")
+	}
+
+	var gusts *gustTracker
+	if viper.GetString("gust_sample_interval") != "" {
+		sample, err := time.ParseDuration(viper.GetString("gust_sample_interval"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse gust_sample_interval")
+		}
+		gusts = newGustTracker(viper.GetInt("gust_warmup_samples"))
+		go gusts.sample(src, sample)
+	}
+
+	stats := &metrics{}
+	exit := func(code int) {
+		if gateway := viper.GetString("pushgateway.url"); gateway != "" {
+			if err := stats.push(gateway, viper.GetString("pushgateway.job")); err != nil {
+				log.WithError(err).Error("Failed to push metrics")
 			}
-			log.Infof("Sent to APRS-IS: %s", f)
+		}
+		os.Exit(code)
+	}
 
+	l := &loop{
+		src:       src,
+		outs:      outs,
+		fields:    fields,
+		seq:       seq,
+		stats:     stats,
+		gusts:     gusts,
+		mode:      mode,
+		interval:  interval,
+		window:    window,
+		fallback:  fallback,
+		keepalive: keepalive,
+		// exit after this many failed iterations in a row so a supervisor can
+		// restart us fresh, 0 retries forever
+		maxFailures: viper.GetInt("max_consecutive_failures"),
+		grace:       interval,
+		started:     time.Now(),
+	}
+	if viper.GetString("startup_grace") != "" {
+		l.grace, err = time.ParseDuration(viper.GetString("startup_grace"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse startup_grace")
+		}
+	}
+
+	pause := &pauseSwitch{}
+	pause.paused.Store(viper.GetBool("pause"))
+	if pause.paused.Load() {
+		log.Warn("Sends paused")
+	}
+	go pause.watch(fConfig)
+
+	remaining := fCount
+	if fOnce {
+		remaining = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	for ; true; <-ticker.C {
+		if pause.paused.Load() {
+			log.Info("Sends paused, skipping this interval")
 			if fOnce {
-				os.Exit(0)
+				exit(exitNoData)
+			}
+			continue
+		}
+
+		code, stop := l.tick()
+		if stop || fOnce {
+			exit(code)
+		}
+		if code == exitSent && remaining > 0 {
+			remaining--
+			if remaining == 0 {
+				exit(exitSent)
+			}
+		}
+	}
+}
+
+// setSoftware sets the software name and version sent in the APRS-IS login,
+// software.version overriding the build version
+func setSoftware() {
+	aprs.SwName = viper.GetString("software.name")
+	aprs.SwVers = version
+	if viper.GetString("software.version") != "" {
+		aprs.SwVers = viper.GetString("software.version")
+	}
+}
+
+// configFiles expands the given paths into the config files to merge. A
+// directory contributes its YAML and JSON files in lexical order.
+func configFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			switch filepath.Ext(e.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(path, e.Name()))
+				}
 			}
-		} else {
-			log.Debug("empty wxData")
 		}
 	}
+	return files, nil
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metrics counts what the main loop has done, in the Prometheus text format
+// so batch runs can push them to a Pushgateway
+type metrics struct {
+	reports    int
+	keepalives int
+	failures   int
+	lastSent   time.Time
+	// values holds the last report's fields by name, see presentValues
+	values map[string]float64
+}
+
+// report records a sent weather report
+func (m *metrics) report(wxData observation) {
+	m.reports++
+	m.lastSent = time.Now()
+	m.values = make(map[string]float64)
+	for name, v := range presentValues(wxData) {
+		if name == "Lat" || name == "Lon" {
+			// the configured position, not a reading
+			continue
+		}
+		if n, err := toNumber(v); err == nil {
+			m.values[name] = n
+		}
+	}
+}
+
+// keepalive records a sent keepalive beacon
+func (m *metrics) keepalive() {
+	m.keepalives++
+	m.lastSent = time.Now()
+}
+
+// write writes the metrics in the Prometheus text exposition format
+func (m *metrics) write(w io.Writer) {
+	counter := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("influx2aprs_reports_sent_total", "Weather reports sent.", m.reports)
+	counter("influx2aprs_keepalives_sent_total", "Keepalive beacons sent.", m.keepalives)
+	counter("influx2aprs_failures_total", "Failed iterations.", m.failures)
+
+	if !m.lastSent.IsZero() {
+		fmt.Fprintf(w, "# HELP influx2aprs_last_sent_timestamp_seconds Time of the last frame sent.\n")
+		fmt.Fprintf(w, "# TYPE influx2aprs_last_sent_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "influx2aprs_last_sent_timestamp_seconds %d\n", m.lastSent.Unix())
+	}
+
+	if len(m.values) > 0 {
+		names := make([]string, 0, len(m.values))
+		for name := range m.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "# HELP influx2aprs_last_value Fields of the last weather report sent, in APRS units.\n")
+		fmt.Fprintf(w, "# TYPE influx2aprs_last_value gauge\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "influx2aprs_last_value{field=%q} %g\n", name, m.values[name])
+		}
+	}
+}
+
+// push replaces the job's metrics on the Pushgateway at gateway
+func (m *metrics) push(gateway, job string) error {
+	var b bytes.Buffer
+	m.write(&b)
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(gateway, "/")+"/metrics/job/"+url.PathEscape(job), &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
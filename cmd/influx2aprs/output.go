@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/acobaugh/aprs"
+	"github.com/spf13/viper"
+)
+
+// output builds frames from observations and sends them with sender
+type output struct {
+	station aprs.Addr
+	tocall  aprs.Addr
+	path    aprs.Path
+	packet  string
+	// split sends weather reports as a position and a positionless report
+	split   bool
+	sender  Sender
+	derived []derivedValue
+	// queue holds this output's frames that failed to send
+	queue *sendQueue
+	// seq is shared by all outputs and advanced once per tick
+	seq *seqCounter
+
+	// comment is used for weather, noData for keepalives without weather
+	comment, noData comments
+
+	// messageTo receives the comment as APRS messages in message mode
+	messageTo string
+	// messageAck requests acknowledgement by numbering each message
+	messageAck bool
+	messageID  int
+
+	// lat and lon are already rounded for transmission, and are used unless
+	// the observation has its own position
+	lat, lon       float64
+	positionDigits int
+	// windDirRound quantizes the wind direction, see quantizeDegrees
+	windDirRound int
+	wxFormat     wxFormat
+	// daylightOnly omits solar radiation while the sun is below minElevation
+	daylightOnly bool
+	minElevation float64
+
+	// prefix and suffix are added around the rendered comment
+	prefix, suffix string
+	// maxComment caps the combined weather report comment, 0 for no limit
+	maxComment int
+	// infoSuffix is raw text appended to weather and position information
+	// fields as is, after the comment
+	infoSuffix string
+}
+
+// newOutput builds an output from v, the top level config or an outputs
+// profile merged over it. interval is the default queue.max_age.
+func newOutput(v *viper.Viper, interval time.Duration) (*output, error) {
+	positionDigits := v.GetInt("position_digits")
+	if positionDigits < 0 || positionDigits > 2 {
+		return nil, fmt.Errorf("position_digits must be between 0 and 2, got %d", positionDigits)
+	}
+
+	packet := v.GetString("packet")
+	if packet != "wx" && packet != "status" && packet != "message" {
+		return nil, fmt.Errorf("packet must be wx, status or message, got %q", packet)
+	}
+	var messageTo string
+	if packet == "message" {
+		if v.GetString("message.to") == "" {
+			return nil, fmt.Errorf("message.to is required for message packets")
+		}
+		var err error
+		messageTo, err = parseAddressee(v.GetString("message.to"))
+		if err != nil {
+			return nil, fmt.Errorf("message.to: %w", err)
+		}
+	}
+
+	style := v.GetString("packet_style")
+	if style != "combined" && style != "split" {
+		return nil, fmt.Errorf("packet_style must be combined or split, got %q", style)
+	}
+
+	call, err := normalizeCall(v.GetString("callsign"))
+	if err != nil {
+		return nil, err
+	}
+	tocall, err := parseAddr(v.GetString("frame.tocall"))
+	if err != nil {
+		return nil, fmt.Errorf("frame.tocall: %w", err)
+	}
+	path, err := parsePath(v.GetStringSlice("frame.path"))
+	if err != nil {
+		return nil, fmt.Errorf("frame.path: %w", err)
+	}
+
+	o := &output{
+		station:        aprs.Addr{Call: call, SSID: v.GetInt("ssid")},
+		tocall:         tocall,
+		path:           path,
+		packet:         packet,
+		split:          style == "split",
+		lat:            roundCoord(v.GetFloat64("lat"), positionDigits),
+		lon:            roundCoord(v.GetFloat64("lon"), positionDigits),
+		positionDigits: positionDigits,
+		windDirRound:   v.GetInt("wind_dir_quantize"),
+		daylightOnly:   v.GetBool("solar_daylight_only"),
+		minElevation:   v.GetFloat64("solar_min_elevation"),
+		messageTo:      messageTo,
+		messageAck:     v.GetBool("message.ack"),
+		prefix:         v.GetString("comment_prefix"),
+		suffix:         v.GetString("comment_suffix"),
+		maxComment:     v.GetInt("comment_max_length"),
+		infoSuffix:     v.GetString("info_suffix"),
+		queue:          &sendQueue{size: v.GetInt("queue.size"), maxAge: interval},
+		seq:            &seqCounter{},
+	}
+
+	o.comment.fallback, err = parseComment(v.GetString("comment"))
+	if err != nil {
+		return nil, fmt.Errorf("comment: %w", err)
+	}
+	o.comment.rules, err = loadCommentRules(v)
+	if err != nil {
+		return nil, err
+	}
+	o.comment.rotation, err = loadCommentRotation(v)
+	if err != nil {
+		return nil, err
+	}
+	o.noData.fallback, err = parseComment(v.GetString("comment_nodata"))
+	if err != nil {
+		return nil, fmt.Errorf("comment_nodata: %w", err)
+	}
+
+	switch v.GetString("timestamp.source") {
+	case "record":
+	case "now":
+		o.wxFormat.now = true
+	default:
+		return nil, fmt.Errorf("timestamp.source must be record or now, got %q", v.GetString("timestamp.source"))
+	}
+	switch v.GetString("timestamp.format") {
+	case "dhm":
+	case "hms":
+		o.wxFormat.hms = true
+	default:
+		return nil, fmt.Errorf("timestamp.format must be dhm or hms, got %q", v.GetString("timestamp.format"))
+	}
+
+	o.wxFormat.symbol, err = parseSymbol(v.GetString("symbol.table"), v.GetString("symbol.code"), v.GetString("symbol.overlay"))
+	if err != nil {
+		return nil, err
+	}
+	if packet == "wx" && !o.split && o.wxFormat.symbol[1] != '_' {
+		// the weather data follows the symbol code in place of a course
+		return nil, fmt.Errorf("symbol.code must be _ with packet_style combined, got %q", v.GetString("symbol.code"))
+	}
+
+	if strings.ContainsAny(o.infoSuffix, "\r\n") || len(o.infoSuffix) > maxInfoLen {
+		return nil, fmt.Errorf("info_suffix must be a single line of at most %d characters", maxInfoLen)
+	}
+
+	if v.GetString("queue.max_age") != "" {
+		o.queue.maxAge, err = time.ParseDuration(v.GetString("queue.max_age"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse queue.max_age: %w", err)
+		}
+	}
+	if v.GetBool("cwop") {
+		// CWOP station IDs have no SSID
+		o.station.SSID = 0
+	}
+	o.derived, err = loadDerived(v)
+	if err != nil {
+		return nil, err
+	}
+	o.sender, err = newSender(v, o.station)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// outputProfiles returns the config of each outputs entry merged over the
+// top level config
+func outputProfiles() ([]*viper.Viper, error) {
+	var profiles []map[string]interface{}
+	if err := viper.UnmarshalKey("outputs", &profiles); err != nil {
+		return nil, err
+	}
+	var vs []*viper.Viper
+	for _, p := range profiles {
+		v := viper.New()
+		if err := v.MergeConfigMap(viper.AllSettings()); err != nil {
+			return nil, err
+		}
+		if err := v.MergeConfigMap(p); err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// frames renders comment for wxData and builds the frames to send, which is
+// more than one for long messages and split weather reports
+func (o *output) frames(wxData observation, comment comments) ([]aprs.Frame, error) {
+	if wxData.hasLat && wxData.hasLon {
+		wxData.Lat = roundCoord(wxData.Lat, o.positionDigits)
+		wxData.Lon = roundCoord(wxData.Lon, o.positionDigits)
+	} else {
+		wxData.Lat = o.lat
+		wxData.Lon = o.lon
+	}
+	if wxData.WindDir >= 0 {
+		wxData.WindDir = quantizeDegrees(wxData.WindDir, o.windDirRound)
+	}
+	if o.daylightOnly && wxData.SolarRad >= 0 {
+		if e := solarElevation(wxData.Lat, wxData.Lon, o.wxFormat.time(wxData.Wx)); e < o.minElevation {
+			log.Debugf("Sun is %.1f degrees up, omitting solar radiation", e)
+			wxData.SolarRad = -1
+			wxData.SolarRadWm2 = -1
+		}
+	}
+
+	data := commentData{observation: wxData, Seq: o.seq.next()}
+	data.Derived = computeDerived(o.derived, data)
+	text, err := comment.render(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var texts []string
+	switch o.packet {
+	case "status":
+		// status reports without a timestamp are limited to 62 characters
+		texts = []string{">" + o.decorate(text, 62)}
+	case "message":
+		texts = o.messages(o.decorate(text, 0))
+	default:
+		text = o.decorate(text, o.maxComment)
+		if o.split {
+			texts = []string{o.withSuffix("!" + encodePosition(wxData.Lat, wxData.Lon, o.wxFormat.symbol) + text)}
+			// keepalives have no weather to report separately
+			if !wxData.Timestamp.IsZero() {
+				texts = append(texts, encodePositionlessWx(wxData.Wx, o.wxFormat))
+			}
+		} else {
+			texts = []string{o.withSuffix(encodeWx(wxData.Wx, text, o.wxFormat))}
+		}
+	}
+
+	var frames []aprs.Frame
+	for _, t := range texts {
+		frames = append(frames, aprs.Frame{
+			Dst:  o.tocall,
+			Src:  o.station,
+			Path: o.path,
+			Text: t,
+		})
+	}
+	return frames, nil
+}
+
+// decorate adds the prefix and suffix to the rendered comment text, first
+// cutting text so the result fits in limit characters with the prefix and
+// suffix whole. A limit of 0 is no limit.
+func (o *output) decorate(text string, limit int) string {
+	if limit <= 0 {
+		return o.prefix + text + o.suffix
+	}
+	room := limit - len(o.prefix) - len(o.suffix)
+	if room < 0 {
+		room = 0
+	}
+	if len(text) > room {
+		text = text[:room]
+	}
+	decorated := o.prefix + text + o.suffix
+	if len(decorated) > limit {
+		// the prefix and suffix alone don't fit
+		decorated = decorated[:limit]
+	}
+	return decorated
+}
+
+// maxMessageLen is the longest APRS message text
+const maxMessageLen = 67
+
+// maxInfoLen is the longest AX.25 information field
+const maxInfoLen = 256
+
+// withSuffix appends infoSuffix to the information field info, leaving it
+// off when the result wouldn't fit in one AX.25 frame
+func (o *output) withSuffix(info string) string {
+	if o.infoSuffix == "" {
+		return info
+	}
+	if len(info)+len(o.infoSuffix) > maxInfoLen {
+		log.Warnf("Omitting info_suffix, the information field would be longer than %d characters", maxInfoLen)
+		return info
+	}
+	return info + o.infoSuffix
+}
+
+// messages formats text as APRS messages to messageTo, split at word
+// boundaries into numbered lines like "1/2 ..." when it doesn't fit in one
+func (o *output) messages(text string) []string {
+	// these characters are reserved in message text
+	text = strings.NewReplacer("|", "", "~", "", "{", "").Replace(text)
+
+	lines := wrap(text, maxMessageLen)
+	if len(lines) > 1 {
+		// leave room for the "n/m " prefix
+		lines = wrap(text, maxMessageLen-len(fmt.Sprintf("%d/%d ", len(lines), len(lines))))
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%d/%d %s", i+1, len(lines), lines[i])
+		}
+	}
+
+	msgs := make([]string, len(lines))
+	for i, line := range lines {
+		msgs[i] = fmt.Sprintf(":%-9s:%s", o.messageTo, line)
+		if o.messageAck {
+			// the recipient acks the number, we don't wait for it
+			o.messageID = o.messageID%99999 + 1
+			msgs[i] += fmt.Sprintf("{%d", o.messageID)
+		}
+	}
+	return msgs
+}
+
+// wrap splits text into lines of at most width characters at spaces,
+// breaking words only when they are longer than a line
+func wrap(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for len(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:width])
+			word = word[width:]
+		}
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// sendAll sends frames in order, returning how many were sent before the
+// first failure
+func (o *output) sendAll(frames []aprs.Frame) (int, error) {
+	for i, f := range frames {
+		if err := o.send(f); err != nil {
+			return i, err
+		}
+	}
+	return len(frames), nil
+}
+
+// send sends f, logging the outcome
+func (o *output) send(f aprs.Frame) error {
+	err := o.sender.Send(f)
+	if err != nil {
+		if isLoginError(err) {
+			log.WithError(err).Errorf("Login to %s failed", o.sender)
+		} else {
+			log.WithError(err).Errorf("Failed to send to %s", o.sender)
+		}
+		return err
+	}
+	log.Infof("Sent to %s: %s", o.sender, f)
+	if frameLog != nil {
+		frameLog.Info(f.String())
+	}
+	return nil
+}
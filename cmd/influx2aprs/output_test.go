@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecorate(t *testing.T) {
+	o := &output{prefix: "WX ", suffix: " example.net"}
+	cases := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"71F 50%", 0, "WX 71F 50% example.net"},
+		{"71F 50%", 43, "WX 71F 50% example.net"},
+		{"a long rendered comment that doesn't fit", 30, "WX a long rendered example.net"},
+		{"anything", 10, "WX  exampl"},
+	}
+	for _, c := range cases {
+		if got := o.decorate(c.text, c.limit); got != c.want {
+			t.Errorf("%q limit %d: got %q, want %q", c.text, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestMessageAddressee(t *testing.T) {
+	v := loadTestConfig(t, map[string]interface{}{
+		"callsign":   "N0CALL",
+		"packet":     "message",
+		"message.to": "n0other-5",
+		"comment":    "71F",
+	})
+	o, err := newOutput(v, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.messages("71F"), []string{":N0OTHER-5:71F"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	v.Set("message.to", "N0OTHER-155")
+	if _, err := newOutput(v, time.Minute); err == nil {
+		t.Error("accepted a 10 character addressee")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// pauseSwitch tracks the pause setting, which is re-read from the config on
+// SIGHUP so sends can be silenced without restarting
+type pauseSwitch struct {
+	paused atomic.Bool
+}
+
+// watch re-reads pause from the config files in paths on every SIGHUP.
+// Nothing else is reloaded.
+func (p *pauseSwitch) watch(paths []string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		paused, err := readPause(paths)
+		if err != nil {
+			log.WithError(err).Error("Failed to reload config, pause unchanged")
+			continue
+		}
+		if p.paused.Swap(paused) != paused {
+			if paused {
+				log.Warn("Sends paused")
+			} else {
+				log.Info("Sends resumed")
+			}
+		}
+	}
+}
+
+// readPause reads the pause setting like main reads the config, into a
+// separate viper so the running config isn't touched
+func readPause(paths []string) (bool, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewBuffer(defaultConfig)); err != nil {
+		return false, err
+	}
+	files, err := configFiles(paths)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		v.SetConfigFile(file)
+		if err := v.MergeInConfig(); err != nil {
+			return false, err
+		}
+	}
+	v.AutomaticEnv()
+	return v.GetBool("pause"), nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "math"
+
+// roundCoord rounds a decimal latitude or longitude to the given number of
+// decimal digits of minutes. APRS positions are transmitted as DDMM.mm, so
+// rounding here first means the formatter never has to round on its own and
+// can't produce out of range values like 44°60.00'.
+func roundCoord(l float64, digits int) float64 {
+	scale := 60 * math.Pow10(digits)
+	r := math.Round(math.Abs(l)*scale) / scale
+	if l < 0 {
+		return -r
+	}
+	return r
+}
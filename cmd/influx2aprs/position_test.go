@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestEncodePosition(t *testing.T) {
+	cases := []struct {
+		name     string
+		lat, lon float64
+		digits   int
+		want     string
+	}{
+		{"north west", 40.5, -77.25, 2, "4030.00N/07715.00W_"},
+		{"south east", -33.8688, 151.2093, 2, "3352.13S/15112.56E_"},
+		{"south west", -34.6037, -58.3816, 2, "3436.22S/05822.90W_"},
+		{"near equator and prime meridian", 0.00001, -0.1278, 2, "0000.00N/00007.67W_"},
+		{"rounds to zero", -0.00001, 0.00001, 2, "0000.00N/00000.00E_"},
+		{"wrap at 59.996", 44 + 59.996/60, -(77 + 59.996/60), 2, "4500.00N/07800.00W_"},
+		{"wrap with 1 digit", -(44 + 59.96/60), 77 + 59.96/60, 1, "4500.00S/07800.00E_"},
+		{"whole minutes", 40.5083, -77.2583, 0, "4030.00N/07715.00W_"},
+	}
+	for _, c := range cases {
+		got := encodePosition(roundCoord(c.lat, c.digits), roundCoord(c.lon, c.digits), "")
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
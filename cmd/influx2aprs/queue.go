@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/acobaugh/aprs"
+)
+
+// sendQueue holds weather frames that failed to send so they can be retried
+// on later ticks. Frames whose observation is older than maxAge are dropped
+// rather than sending outdated weather once the connection recovers.
+type sendQueue struct {
+	size   int
+	maxAge time.Duration
+	frames []queuedFrame
+}
+
+type queuedFrame struct {
+	frame    aprs.Frame
+	observed time.Time
+}
+
+// push queues frames, dropping the oldest when the queue is full. A queue
+// with size 0 is disabled.
+func (q *sendQueue) push(observed time.Time, frames ...aprs.Frame) {
+	if q.size <= 0 {
+		return
+	}
+	for _, f := range frames {
+		if len(q.frames) >= q.size {
+			log.Warnf("Send queue full, discarding %s", q.frames[0].frame)
+			q.frames = q.frames[1:]
+		}
+		q.frames = append(q.frames, queuedFrame{frame: f, observed: observed})
+	}
+}
+
+// flush sends queued frames oldest first, stopping at the first failure. It
+// returns how many were sent.
+func (q *sendQueue) flush(out *output) (int, error) {
+	sent := 0
+	for len(q.frames) > 0 {
+		qf := q.frames[0]
+		if age := time.Since(qf.observed); age > q.maxAge {
+			log.Warnf("Discarding queued frame observed %s ago: %s", age.Round(time.Second), qf.frame)
+			q.frames = q.frames[1:]
+			continue
+		}
+		if err := out.send(qf.frame); err != nil {
+			return sent, err
+		}
+		q.frames = q.frames[1:]
+		sent++
+	}
+	return sent, nil
+}
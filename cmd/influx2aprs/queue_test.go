@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/acobaugh/aprs"
+)
+
+// recordingSender records the text of each frame sent, failing while down
+type recordingSender struct {
+	down bool
+	sent []string
+}
+
+func (s *recordingSender) Send(f aprs.Frame) error {
+	if s.down {
+		return errors.New("down")
+	}
+	s.sent = append(s.sent, f.Text)
+	return nil
+}
+
+func (s *recordingSender) String() string {
+	return "recording"
+}
+
+func textFrames(texts ...string) []aprs.Frame {
+	var frames []aprs.Frame
+	for _, t := range texts {
+		frames = append(frames, aprs.Frame{Text: t})
+	}
+	return frames
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	sender := &recordingSender{}
+	o := &output{sender: sender, queue: &sendQueue{size: 10, maxAge: time.Hour}}
+	o.queue.push(time.Now().Add(-2*time.Hour), textFrames("stale")...)
+	o.queue.push(time.Now(), textFrames("fresh")...)
+	if _, err := o.queue.flush(o); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fresh"}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("sent %q, want %q", sender.sent, want)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	sender := &recordingSender{}
+	o := &output{sender: sender, queue: &sendQueue{size: 2, maxAge: time.Hour}}
+	o.queue.push(time.Now(), textFrames("1", "2", "3")...)
+	if _, err := o.queue.flush(o); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2", "3"}; !reflect.DeepEqual(sender.sent, want) {
+		t.Errorf("sent %q, want %q", sender.sent, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/acobaugh/aprs"
+	"github.com/spf13/viper"
+)
+
+// Sender delivers frames to a destination, serializing them as it needs: TNC2
+// text for APRS-IS and UDP, AX.25 in KISS for a TNC. The main loop only
+// depends on this so tests can substitute a recording implementation.
+type Sender interface {
+	Send(aprs.Frame) error
+	// String describes the destination for logging
+	String() string
+}
+
+// newSender returns the Sender for the transport configured in v. station is the
+// frame source, which APRS-IS needs for the passcode.
+func newSender(v *viper.Viper, station aprs.Addr) (Sender, error) {
+	switch v.GetString("transport") {
+	case "aprsis":
+		s := &isSender{
+			server: v.GetString("aprsis.server"),
+			pass:   genPass(station.Call),
+		}
+		if v.GetString("aprsis.connect_timeout") != "" {
+			var err error
+			s.timeout, err = time.ParseDuration(v.GetString("aprsis.connect_timeout"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse aprsis.connect_timeout: %w", err)
+			}
+		}
+		if v.GetString("aprsis.passcode") != "" {
+			s.pass = v.GetInt("aprsis.passcode")
+		}
+		if v.GetBool("cwop") {
+			// CWOP stations aren't hams, they log in unverified
+			s.server = "cwop.aprs.net:14580"
+			s.pass = -1
+		}
+		if v.GetBool("aprsis.persistent") {
+			s.held = &heldConn{addr: s.server, pass: s.pass, timeout: s.timeout}
+			if v.GetString("aprsis.keepalive") != "" {
+				var err error
+				s.held.keepalive, err = time.ParseDuration(v.GetString("aprsis.keepalive"))
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse aprsis.keepalive: %w", err)
+				}
+			}
+			if v.GetString("aprsis.quiet_timeout") != "" {
+				var err error
+				s.held.quiet, err = time.ParseDuration(v.GetString("aprsis.quiet_timeout"))
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse aprsis.quiet_timeout: %w", err)
+				}
+			}
+		}
+		return s, nil
+	case "udp":
+		return &udpSender{
+			addr: net.JoinHostPort(v.GetString("udp.host"), v.GetString("udp.port")),
+		}, nil
+	case "kiss":
+		// AX.25 addresses hold 6 characters and a 4 bit SSID
+		if len(station.Call) > 6 {
+			return nil, fmt.Errorf("callsign %q must be at most 6 characters with transport kiss", station.Call)
+		}
+		if station.SSID < 0 || station.SSID > 15 {
+			return nil, fmt.Errorf("ssid must be between 0 and 15 with transport kiss, got %d", station.SSID)
+		}
+		s := &kissSender{
+			addr: net.JoinHostPort(v.GetString("kiss.host"), v.GetString("kiss.port")),
+		}
+		if v.GetString("kiss.connect_timeout") != "" {
+			var err error
+			s.timeout, err = time.ParseDuration(v.GetString("kiss.connect_timeout"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse kiss.connect_timeout: %w", err)
+			}
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("transport must be aprsis, udp or kiss, got %q", v.GetString("transport"))
+}
+
+// isSender logs in to an APRS-IS server for each frame, or once when held
+type isSender struct {
+	server  string
+	pass    int
+	timeout time.Duration
+	// held keeps one connection open for aprsis.persistent
+	held *heldConn
+}
+
+func (s *isSender) Send(f aprs.Frame) error {
+	if s.held != nil {
+		return s.held.send(f)
+	}
+	return sendIS(f, "tcp://"+s.server, s.pass, s.timeout)
+}
+
+func (s *isSender) String() string {
+	return s.server
+}
+
+// udpSender sends each frame as a TNC2 line in a datagram. UDP is fire and
+// forget, so errors are only logged and never queue frames or count as
+// failures.
+type udpSender struct {
+	addr string
+}
+
+func (s *udpSender) Send(f aprs.Frame) error {
+	if err := sendUDPLine(f, s.addr); err != nil {
+		log.WithError(err).Errorf("Failed to send to %s", s)
+	}
+	return nil
+}
+
+func (s *udpSender) String() string {
+	return "udp://" + s.addr
+}
+
+// kissSender sends each frame as AX.25 to a KISS over TCP TNC
+type kissSender struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (s *kissSender) Send(f aprs.Frame) error {
+	return sendKISS(f, s.addr, s.timeout)
+}
+
+func (s *kissSender) String() string {
+	return "kiss://" + s.addr
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// seqCounter numbers sent beacons for {{.Seq}} so gaps show up on the
+// receiving end. With file set the count survives restarts.
+type seqCounter struct {
+	n    int
+	file string
+}
+
+// loadSeq returns a counter continuing from file, starting at 0 if it
+// doesn't exist yet. The saved count can't be negative.
+func loadSeq(file string) (*seqCounter, error) {
+	c := &seqCounter{file: file}
+	if file == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.n, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	// a negative count would index the comment rotation out of range
+	if c.n < 0 {
+		return nil, fmt.Errorf("sequence number %d in %s is negative", c.n, file)
+	}
+	return c, nil
+}
+
+// next is the number of the next beacon
+func (c *seqCounter) next() int {
+	return c.n + 1
+}
+
+// advance counts a sent beacon
+func (c *seqCounter) advance() {
+	c.n++
+	if c.file == "" {
+		return
+	}
+	if err := os.WriteFile(c.file, []byte(strconv.Itoa(c.n)+"\n"), 0o644); err != nil {
+		log.WithError(err).Warnf("Failed to save sequence number to %s", c.file)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSeq(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+		want     int
+		wantErr  bool
+	}{
+		{name: "saved", contents: "41\n", want: 41},
+		{name: "zero", contents: "0\n", want: 0},
+		{name: "negative", contents: "-3\n", wantErr: true},
+		{name: "garbage", contents: "x\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(file, []byte(tt.contents), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadSeq(file)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %d, want an error", c.n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.n != tt.want {
+				t.Errorf("got %d, want %d", c.n, tt.want)
+			}
+		})
+	}
+
+	c, err := loadSeq(filepath.Join(dir, "missing"))
+	if err != nil || c.n != 0 {
+		t.Errorf("missing file: got %v, %v", c, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/acobaugh/aprs"
+)
+
+// normalizeCall trims and upper cases a callsign, rejecting anything but
+// letters and digits. APRS-IS allows up to 9 characters, the SSID is
+// configured separately.
+func normalizeCall(call string) (string, error) {
+	call = strings.ToUpper(strings.TrimSpace(call))
+	if call == "" || len(call) > 9 {
+		return "", fmt.Errorf("callsign %q must be 1 to 9 characters", call)
+	}
+	if i := strings.IndexFunc(call, func(r rune) bool {
+		return (r < 'A' || r > 'Z') && (r < '0' || r > '9')
+	}); i >= 0 {
+		return "", fmt.Errorf("callsign %q has invalid character %q, set the SSID with ssid", call, call[i])
+	}
+	return call, nil
+}
+
+// parseAddressee parses a message addressee like N0CALL-5, upper cased. The
+// addressee field holds 9 characters, SSID included.
+func parseAddressee(s string) (string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) > 9 {
+		return "", fmt.Errorf("addressee %q must be at most 9 characters", s)
+	}
+	call, ssid, hasSSID := strings.Cut(s, "-")
+	if _, err := normalizeCall(call); err != nil {
+		return "", err
+	}
+	if hasSSID {
+		if n, err := strconv.Atoi(ssid); err != nil || n < 0 || n > 15 {
+			return "", fmt.Errorf("addressee %q: SSID must be between 0 and 15", s)
+		}
+	}
+	return s, nil
+}
+
+// parseAddr parses a tocall or path entry like WIDE2-1 or TCPIP*, upper
+// cased. These go out over AX.25 as well, so aprs.Addr.FromString limits
+// them to 6 characters.
+func parseAddr(s string) (aprs.Addr, error) {
+	var a aprs.Addr
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if err := a.FromString(s); err != nil {
+		return a, fmt.Errorf("%q: %w", s, err)
+	}
+	if _, err := normalizeCall(a.Call); err != nil {
+		return a, fmt.Errorf("%q: invalid callsign", s)
+	}
+	return a, nil
+}
+
+// parsePath parses each path entry with parseAddr
+func parsePath(entries []string) (aprs.Path, error) {
+	var path aprs.Path
+	for _, e := range entries {
+		a, err := parseAddr(e)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, a)
+	}
+	return path, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseAddressee(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"n0call", "N0CALL", false},
+		{" N0CALL-5 ", "N0CALL-5", false},
+		{"CW1234", "CW1234", false},
+		{"AB1CDE-15", "AB1CDE-15", false},
+		{"AB1CDEF-15", "", true},
+		{"N0CALL-16", "", true},
+		{"N0CALL-", "", true},
+		{"N0 CALL", "", true},
+		{"BLN1:WX", "", true},
+	}
+	for _, c := range cases {
+		got, err := parseAddressee(c.in)
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("%q: got %q, %v, want %q, error %t", c.in, got, err, c.want, c.wantErr)
+		}
+	}
+}
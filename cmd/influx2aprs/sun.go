@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// solarElevation returns the sun's elevation above the horizon in degrees at
+// lat and lon at t, ignoring refraction. This is the NOAA approximation,
+// which is within a fraction of a degree and plenty to tell day from night.
+func solarElevation(lat, lon float64, t time.Time) float64 {
+	t = t.UTC()
+	rad := math.Pi / 180
+
+	// fractional year in radians
+	hour := float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+	g := 2 * math.Pi / 365 * (float64(t.YearDay()-1) + (hour-12)/24)
+
+	// equation of time in minutes and declination in radians
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) -
+		0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	decl := 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) -
+		0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+
+	// hour angle from true solar time in minutes
+	solarTime := hour*60 + eqTime + 4*lon
+	ha := (solarTime/4 - 180) * rad
+
+	cosZenith := math.Sin(lat*rad)*math.Sin(decl) + math.Cos(lat*rad)*math.Cos(decl)*math.Cos(ha)
+	return 90 - math.Acos(math.Max(-1, math.Min(1, cosZenith)))/rad
+}
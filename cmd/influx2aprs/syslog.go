@@ -0,0 +1,51 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+	"github.com/spf13/viper"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// setupSyslog sends logs to the local syslog daemon as configured under log,
+// either everything logged or only the frames sent, via frameLog
+func setupSyslog() error {
+	if !viper.GetBool("log.syslog") {
+		return nil
+	}
+	facility, ok := syslogFacilities[viper.GetString("log.facility")]
+	if !ok {
+		return fmt.Errorf("log.facility must be user, daemon or local0 to local7, got %q", viper.GetString("log.facility"))
+	}
+	hook, err := lSyslog.NewSyslogHook("", "", facility|syslog.LOG_INFO, viper.GetString("log.tag"))
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool("log.frames_only") {
+		frameLog = logrus.New()
+		frameLog.SetOutput(io.Discard)
+		frameLog.AddHook(hook)
+		return nil
+	}
+	log.AddHook(hook)
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+
+	"github.com/spf13/viper"
+)
+
+// setupSyslog fails when log.syslog is set, there's no syslog here
+func setupSyslog() error {
+	if viper.GetBool("log.syslog") {
+		return errors.New("log.syslog is not supported on this platform")
+	}
+	return nil
+}
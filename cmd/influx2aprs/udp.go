@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net"
+
+	"github.com/acobaugh/aprs"
+)
+
+// sendUDPLine sends f's TNC2 string as a single datagram to addr. There's no
+// login or acknowledgement, so errors only cover resolving and writing.
+func sendUDPLine(f aprs.Frame, addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(f.String() + "\r\n"))
+	return err
+}
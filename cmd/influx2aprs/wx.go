@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/acobaugh/aprs"
+)
+
+// observation is a weather observation, aprs.Wx plus the fields APRS has
+// no slot for, which are only available to the comment template
+type observation struct {
+	aprs.Wx
+	// WindGustDir is the direction of the peak gust in degrees, or -1
+	WindGustDir int
+
+	// the converted values before rounding to the whole numbers the report
+	// carries, with the same placeholders as their aprs.Wx fields
+	TempF        float64
+	HumidityPct  float64
+	SolarRadWm2  float64
+	WindSpeedMph float64
+	WindGustMph  float64
+
+	// hasLat and hasLon are set when the position came from InfluxDB
+	hasLat, hasLon bool
+}
+
+// Zero sets all fields to their no reading placeholders
+func (w *observation) Zero() {
+	w.Wx.Zero()
+	w.WindGustDir = -1
+	w.TempF = -100
+	w.HumidityPct = -1
+	w.SolarRadWm2 = -1
+	w.WindSpeedMph = -1
+	w.WindGustMph = -1
+	w.hasLat, w.hasLon = false, false
+}
+
+// wxFormat controls how weather reports are encoded
+type wxFormat struct {
+	// now stamps reports with the send time instead of the observation time
+	now bool
+	// hms uses the HHMMSSh timestamp format instead of DDHHMMz
+	hms bool
+	// symbol is the symbol table identifier, or overlay, and symbol code,
+	// the primary table weather station /_ when empty
+	symbol string
+}
+
+// time returns the time w is stamped with, in UTC
+func (format wxFormat) time(w aprs.Wx) time.Time {
+	ts := w.Timestamp
+	if format.now || ts.IsZero() {
+		ts = time.Now()
+	}
+	return ts.In(time.UTC)
+}
+
+// encodeWx returns the information field of a complete weather report with
+// position and timestamp, followed by comment. This follows aprs.Wx.String,
+// which only supports DHM timestamps, see APRS Protocol Reference 1.0 chapter
+// 12. w.Type is ignored: aprs.Wx.String appends it as the free text after the
+// weather data, where the spec allows a software and station type but
+// anything goes in practice, and sends "GolangAPRS" when it is empty. An
+// empty comment here ends the report after the last weather field.
+func encodeWx(w aprs.Wx, comment string, format wxFormat) (s string) {
+	ts := format.time(w)
+	if format.hms {
+		s = "@" + ts.Format("150405") + "h"
+	} else {
+		s = "@" + ts.Format("021504") + "z"
+	}
+	s += encodePosition(w.Lat, w.Lon, format.symbol)
+
+	if w.WindDir < 0 {
+		s += "..."
+	} else {
+		s += fmt.Sprintf("%03d", w.WindDir)
+	}
+
+	if w.WindSpeed < 0 {
+		s += "/..."
+	} else {
+		s += fmt.Sprintf("/%03d", w.WindSpeed)
+	}
+
+	s += encodeWxFields(w) + comment
+	return
+}
+
+// encodePositionlessWx returns the information field of a positionless
+// weather report, which has an MDHM timestamp, wind as c and s fields and no
+// comment
+func encodePositionlessWx(w aprs.Wx, format wxFormat) (s string) {
+	s = "_" + format.time(w).Format("01021504")
+
+	if w.WindDir < 0 {
+		s += "c..."
+	} else {
+		s += fmt.Sprintf("c%03d", w.WindDir)
+	}
+
+	if w.WindSpeed < 0 {
+		s += "s..."
+	} else {
+		s += fmt.Sprintf("s%03d", w.WindSpeed)
+	}
+
+	s += encodeWxFields(w)
+	return
+}
+
+// encodePosition returns lat and lon as an uncompressed position with
+// symbol, defaulting to the weather station. The symbol table identifier goes
+// between them and the code after.
+func encodePosition(lat, lon float64, symbol string) string {
+	if symbol == "" {
+		symbol = "/_"
+	}
+	latDeg, latMin, latHem := decToDM(lat, "N", "S")
+	lonDeg, lonMin, lonHem := decToDM(lon, "E", "W")
+	return fmt.Sprintf("%02.0f%05.2f%s%c%03.0f%05.2f%s%c",
+		latDeg, latMin, latHem, symbol[0],
+		lonDeg, lonMin, lonHem, symbol[1])
+}
+
+// parseSymbol returns the symbol for table, code and overlay. An overlay is a
+// digit or capital letter shown on an alternate table symbol, and takes the
+// place of the table identifier.
+func parseSymbol(table, code, overlay string) (string, error) {
+	if table != "/" && table != "\\" {
+		return "", fmt.Errorf("symbol.table must be / or \\, got %q", table)
+	}
+	if len(code) != 1 || code[0] < '!' || code[0] > '~' {
+		return "", fmt.Errorf("symbol.code must be a single printable character, got %q", code)
+	}
+	if overlay == "" {
+		return table + code, nil
+	}
+	if table != "\\" {
+		return "", fmt.Errorf("symbol.overlay requires the alternate table \\")
+	}
+	if len(overlay) != 1 || !(overlay[0] >= '0' && overlay[0] <= '9' || overlay[0] >= 'A' && overlay[0] <= 'Z') {
+		return "", fmt.Errorf("symbol.overlay must be a single digit or capital letter, got %q", overlay)
+	}
+	return overlay + code, nil
+}
+
+// encodeWxFields returns the weather fields following the wind direction and
+// speed, which are the same in both report formats
+func encodeWxFields(w aprs.Wx) (s string) {
+	if w.WindGust < 0 {
+		s += "g..."
+	} else {
+		s += fmt.Sprintf("g%03d", w.WindGust)
+	}
+
+	// three characters including the sign, so -5 is t-05 and -15 is t-15
+	if w.Temp < -99 {
+		s += "t..."
+	} else {
+		s += fmt.Sprintf("t%03d", w.Temp)
+	}
+
+	if w.RainLastHour < 0.0 {
+		s += "r..."
+	} else {
+		s += fmt.Sprintf("r%03d", rainHundredths(w.RainLastHour))
+	}
+
+	if w.RainLast24Hours < 0.0 {
+		s += "p..."
+	} else {
+		s += fmt.Sprintf("p%03d", rainHundredths(w.RainLast24Hours))
+	}
+
+	if w.RainToday < 0.0 {
+		s += "P..."
+	} else {
+		s += fmt.Sprintf("P%03d", rainHundredths(w.RainToday))
+	}
+
+	if w.Humidity < 0 {
+		s += "h.."
+	} else {
+		s += fmt.Sprintf("h%02d", w.Humidity%100)
+	}
+
+	if w.Pressure <= 0.0 {
+		s += "b....."
+	} else {
+		s += fmt.Sprintf("b%05.0f", w.Pressure*10.0)
+	}
+
+	// L is 0-999 W/m2 and l is 1000-1999 less 1000, with anything above
+	// reported as 1999 rather than overflowing into the comment
+	switch {
+	case w.SolarRad > 1999:
+		log.Debugf("solar radiation %d W/m2 exceeds the field, reporting 1999", w.SolarRad)
+		s += "l999"
+	case w.SolarRad >= 1000:
+		s += fmt.Sprintf("l%03d", w.SolarRad-1000)
+	case w.SolarRad >= 0:
+		s += fmt.Sprintf("L%03d", w.SolarRad)
+	}
+	return
+}
+
+// rainHundredths rounds rain in inches to the hundredths APRS reports. The
+// field is three digits, so anything above 9.99" is reported as 9.99" rather
+// than overflowing into the next field.
+func rainHundredths(in float64) int {
+	n := int(math.Round(in * 100))
+	if n > 999 {
+		log.Debugf("rain %.2f in exceeds the 3 digit field, reporting 9.99", in)
+		return 999
+	}
+	return n
+}
+
+// decToDM splits a decimal latitude or longitude into whole degrees, decimal
+// minutes and hemisphere
+func decToDM(l float64, pos, neg string) (float64, float64, string) {
+	deg, frac := math.Modf(math.Abs(l))
+	if l < 0 {
+		return deg, frac * 60, neg
+	}
+	return deg, frac * 60, pos
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRainHundredths(t *testing.T) {
+	mm := rainUnits["mm"]
+	cases := []struct {
+		mm   float64
+		want int
+	}{
+		{0, 0},
+		{0.2, 1},
+		{2.54, 10},
+		{12.7, 50},
+		{25.4, 100},
+		{100, 394},
+		{253.7, 999},
+		// 9.996" rounds to 1000 hundredths, one past the field
+		{253.9, 999},
+		{500, 999},
+	}
+	for _, c := range cases {
+		if got := rainHundredths(mm(c.mm)); got != c.want {
+			t.Errorf("%.1f mm: got %d, want %d", c.mm, got, c.want)
+		}
+	}
+}
+
+func TestTempField(t *testing.T) {
+	cases := []struct {
+		f    float64
+		want string
+	}{
+		{71.4, "t071"},
+		{-5, "t-05"},
+		{-15, "t-15"},
+		{-0.4, "t000"},
+		{0.4, "t000"},
+		{-0.6, "t-01"},
+		{-99.4, "t-99"},
+		{-105, "t-99"},
+		{-150, "t-99"},
+		{1200, "t999"},
+	}
+	for _, c := range cases {
+		var w observation
+		w.Zero()
+		w.Temp = clampTemp(c.f)
+		if got := encodeWxFields(w.Wx); !strings.Contains(got, "g..."+c.want+"r") {
+			t.Errorf("%.1f F: got %s, want %s", c.f, got, c.want)
+		}
+	}
+}
+
+func TestSolarRadField(t *testing.T) {
+	cases := []struct {
+		wm2  int
+		want string
+	}{
+		{-1, ""},
+		{0, "L000"},
+		{999, "L999"},
+		{1000, "l000"},
+		{1999, "l999"},
+		{2000, "l999"},
+	}
+	for _, c := range cases {
+		var w observation
+		w.Zero()
+		w.SolarRad = c.wm2
+		if got := encodeWxFields(w.Wx); !strings.HasSuffix(got, "b....."+c.want) {
+			t.Errorf("%d W/m2: got %s, want %s", c.wm2, got, c.want)
+		}
+	}
+}
+
+func TestEncodeWxEmptyComment(t *testing.T) {
+	var w observation
+	w.Zero()
+	w.Timestamp = time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	w.Lat, w.Lon = 40.5, -77.25
+	w.WindDir, w.WindSpeed, w.Temp, w.Humidity = 90, 5, 71, 50
+
+	want := "@040506z4030.00N/07715.00W_090/005g...t071r...p...P...h50b....."
+	if got := encodeWx(w.Wx, "", wxFormat{}); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
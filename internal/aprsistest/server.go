@@ -0,0 +1,162 @@
+// Package aprsistest provides a fake APRS-IS server for exercising the send
+// path without touching the real network.
+package aprsistest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an APRS-IS server listening on localhost. It completes the
+// login handshake and records each login line and frame it receives.
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr string
+	// Unverified answers every login as unverified, as APRS-IS does for a
+	// wrong passcode
+	Unverified bool
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[net.Conn]bool
+	logins []string
+	frames []string
+}
+
+// NewServer starts a server on a random localhost port. Callers should Close
+// it when done.
+func NewServer() *Server {
+	s := &Server{}
+	s.Start()
+	return s
+}
+
+// Start starts a server configured before starting, e.g.
+// &Server{Unverified: true}, on a random localhost port
+func (s *Server) Start() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("aprsistest: failed to listen: %v", err))
+	}
+	s.Addr = l.Addr().String()
+	s.listener = l
+	s.conns = make(map[net.Conn]bool)
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close stops listening, closes open connections, such as one a client
+// keeps open between sends, and waits for their handlers to finish
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Logins returns the login lines received so far
+func (s *Server) Logins() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.logins...)
+}
+
+// Frames returns the TNC2 frames received so far, without keepalive comments
+func (s *Server) Frames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.frames...)
+}
+
+// WaitFrames returns the frames received once there are at least n, or what
+// has been received when timeout passes first. Frames arrive asynchronously
+// to the client's send returning.
+func (s *Server) WaitFrames(n int, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		frames := s.Frames()
+		if len(frames) >= n || time.Now().After(deadline) {
+			return frames
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	fmt.Fprintf(conn, "# aprsistest\r\n")
+
+	r := bufio.NewReader(conn)
+	login, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	login = strings.TrimSpace(login)
+	s.mu.Lock()
+	s.logins = append(s.logins, login)
+	s.mu.Unlock()
+
+	// user CALL pass PASS vers NAME VERSION
+	fields := strings.Fields(login)
+	call := ""
+	if len(fields) > 1 {
+		call = fields[1]
+	}
+	status := "verified"
+	if s.Unverified || len(fields) < 4 || fields[3] == "-1" {
+		status = "unverified"
+	}
+	fmt.Fprintf(conn, "# logresp %s %s, server TEST\r\n", call, status)
+
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			s.mu.Lock()
+			s.frames = append(s.frames, line)
+			s.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}